@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// APIError is the JSON body returned by the REST API on errors.
+type APIError struct {
+	Error string `json:"error"`
+}
+
+// writeJSON writes a value as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("error converting response to JSON: %v", err)
+		status = 500
+		data = []byte(`{"error":"Internal server error"}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// writeJSONError writes an APIError response.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, APIError{Error: message})
+}
+
+// readJSON decodes a JSON request body, writing an error response and
+// returning false if the body is not valid.
+func readJSON(w http.ResponseWriter, r *http.Request, value interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(value); err != nil {
+		writeJSONError(w, 400, "Invalid JSON body")
+		return false
+	}
+
+	return true
+}
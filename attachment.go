@@ -0,0 +1,414 @@
+package main
+
+import (
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Most attachments a message can have.
+const maxAttachments = 10
+
+// Longest file name kept for an attachment, in bytes.
+const maxAttachmentNameLength = 255
+
+// How often unsent uploads and the attachments of deleted messages are
+// removed.
+const attachmentSweepPeriod = 10 * time.Minute
+
+// Attachment is an uploaded file. It belongs to its uploader until it is sent
+// in a message, after which everyone in the conversation can download it.
+type Attachment struct {
+	ID          int64  `json:"id"`
+	MessageID   int64  `json:"message_id,omitempty"`
+	Name        string `json:"name,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	CreatedAt   int64  `json:"created_at,omitempty"`
+
+	// Dimensions of images.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+
+	// Download URLs, filled in when the attachment is handed to a client.
+	URL          string `json:"url,omitempty"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+
+	uploaderID int
+
+	// Where the file and the thumbnail of an image are kept in the blob
+	// store.
+	blobKey      string
+	thumbnailKey string
+}
+
+// withURLs returns the attachment with its download URLs filled in.
+func (a Attachment) withURLs() Attachment {
+	a.URL = "/attachments/" + strconv.FormatInt(a.ID, 10)
+	if a.thumbnailKey != "" {
+		a.ThumbnailURL = a.URL + "/thumbnail"
+	}
+
+	return a
+}
+
+// thumbnailContentType returns the content type of the thumbnail of an
+// attachment. See encodeImage.
+func (a Attachment) thumbnailContentType() string {
+	if a.ContentType == "image/jpeg" {
+		return "image/jpeg"
+	}
+
+	return "image/png"
+}
+
+// isImage reports whether files of the content type are images that get a
+// thumbnail.
+func isImage(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+
+	return false
+}
+
+// resolveAttachments replaces the attachments a new message refers to by ID
+// with the stored ones. Only attachments uploaded by the sender and not yet
+// sent in another message can be used. Runs in the readPump, see prepare.
+func (h *Hub) resolveAttachments(message *Message) *ProtocolError {
+	if len(message.Attachments) == 0 {
+		return nil
+	}
+
+	senderID, _ := strconv.Atoi(message.Sender)
+	seen := make(map[int64]bool)
+
+	attachments := make([]Attachment, 0, len(message.Attachments))
+	for _, requested := range message.Attachments {
+		if seen[requested.ID] {
+			return protocolError(errorInvalidMessage, "Attachment given twice")
+		}
+		seen[requested.ID] = true
+
+		attachment, err := h.store.getAttachment(requested.ID)
+		if err == errNotFound || (err == nil && attachment.uploaderID != senderID) {
+			return protocolError(errorInvalidMessage, "Attachment not found")
+		}
+		if err != nil {
+			log.Printf("error getting attachment: %v", err)
+			return protocolError(errorInternal, "Attachment could not be read")
+		}
+
+		if attachment.MessageID != 0 {
+			return protocolError(errorInvalidMessage, "Attachment has already been sent")
+		}
+
+		attachments = append(attachments, attachment.withURLs())
+	}
+
+	message.Attachments = attachments
+
+	return nil
+}
+
+// attachAttachments fills in the attachments of messages. Deleted messages
+// have none.
+func attachAttachments(store Store, messages []Message) error {
+	var messageIDs []int64
+	for _, message := range messages {
+		if message.DeletedAt == 0 {
+			messageIDs = append(messageIDs, message.ID)
+		}
+	}
+
+	if len(messageIDs) == 0 {
+		return nil
+	}
+
+	attachments, err := store.messageAttachments(messageIDs)
+	if err != nil {
+		return err
+	}
+
+	byMessage := make(map[int64][]Attachment)
+	for _, attachment := range attachments {
+		byMessage[attachment.MessageID] = append(byMessage[attachment.MessageID], attachment.withURLs())
+	}
+
+	for i := range messages {
+		messages[i].Attachments = byMessage[messages[i].ID]
+	}
+
+	return nil
+}
+
+// readUpload reads the file part of a multipart upload. It writes an error
+// response and returns false if there is no file or it is too large.
+func readUpload(w http.ResponseWriter, r *http.Request, maxSize int) (string, []byte, bool) {
+	// Leave room for the multipart headers.
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxSize)+64<<10)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeJSONError(w, 400, "Expected a multipart/form-data body")
+		return "", nil, false
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			writeJSONError(w, 400, "Missing file")
+			return "", nil, false
+		}
+		if err != nil {
+			writeJSONError(w, 400, "Invalid multipart body")
+			return "", nil, false
+		}
+
+		if part.FormName() != "file" {
+			continue
+		}
+
+		data, err := io.ReadAll(io.LimitReader(part, int64(maxSize)+1))
+		if err != nil {
+			writeJSONError(w, 400, "Invalid multipart body")
+			return "", nil, false
+		}
+
+		if len(data) > maxSize {
+			writeJSONError(w, 413, "File is too large, the limit is "+strconv.Itoa(maxSize)+" bytes")
+			return "", nil, false
+		}
+
+		if len(data) == 0 {
+			writeJSONError(w, 400, "File is empty")
+			return "", nil, false
+		}
+
+		return part.FileName(), data, true
+	}
+}
+
+// attachmentName cleans up the file name given by the client.
+func attachmentName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if !utf8.ValidString(name) || name == "." || name == "/" {
+		name = ""
+	}
+
+	for len(name) > maxAttachmentNameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+
+	if name == "" {
+		return "file"
+	}
+
+	return name
+}
+
+// serveUploadAttachment stores the file in the file field of a multipart
+// body. The content type is sniffed from the data and images get a
+// thumbnail. The attachment can then be sent in a message.
+func serveUploadAttachment(store Store, blobs BlobStore, w http.ResponseWriter, r *http.Request, userID int) {
+	log.Println(r.URL)
+
+	name, data, ok := readUpload(w, r, config.Attachments.MaxSizeBytes)
+	if !ok {
+		return
+	}
+
+	attachment := Attachment{
+		Name:        attachmentName(name),
+		ContentType: http.DetectContentType(data),
+		Size:        int64(len(data)),
+		CreatedAt:   time.Now().UnixNano() / int64(time.Millisecond),
+		uploaderID:  userID,
+	}
+
+	var thumbnail []byte
+	if isImage(attachment.ContentType) {
+		img, format, err := decodeImage(data)
+		if err != nil {
+			// Keep it as a plain file.
+			log.Printf("error decoding uploaded image: %v", err)
+		} else {
+			attachment.Width, attachment.Height = img.Bounds().Dx(), img.Bounds().Dy()
+			if thumbnail, _, err = encodeImage(fitImage(img, config.Attachments.ThumbnailSize), format); err != nil {
+				log.Printf("error encoding thumbnail: %v", err)
+				thumbnail = nil
+			}
+		}
+	}
+
+	var err error
+	if attachment.blobKey, err = newBlobKey(); err != nil {
+		log.Printf("error generating blob key: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	if err := blobs.put(attachment.blobKey, data, attachment.ContentType); err != nil {
+		log.Printf("error storing attachment: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	if thumbnail != nil {
+		attachment.thumbnailKey = attachment.blobKey + "-thumbnail"
+		if err := blobs.put(attachment.thumbnailKey, thumbnail, attachment.thumbnailContentType()); err != nil {
+			log.Printf("error storing thumbnail: %v", err)
+			attachment.thumbnailKey = ""
+		}
+	}
+
+	if err := store.createAttachment(&attachment); err != nil {
+		log.Printf("error creating attachment: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		removeBlobs(blobs, attachment.blobKey, attachment.thumbnailKey)
+		return
+	}
+
+	writeJSON(w, 201, attachment.withURLs())
+}
+
+// sweepAttachments removes the uploads that were not sent in time and the
+// attachments of deleted messages, together with their blobs, every
+// attachmentSweepPeriod.
+func sweepAttachments(store Store, blobs BlobStore) {
+	ticker := time.NewTicker(attachmentSweepPeriod)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expiry := time.Duration(config.Attachments.UnsentExpirySeconds) * time.Second
+		attachments, err := store.deleteStaleAttachments(time.Now().Add(-expiry).UnixNano() / int64(time.Millisecond))
+		if err != nil {
+			log.Printf("error deleting stale attachments: %v", err)
+			continue
+		}
+
+		for _, attachment := range attachments {
+			removeBlobs(blobs, attachment.blobKey, attachment.thumbnailKey)
+		}
+	}
+}
+
+// removeBlobs removes the blobs with the given keys, skipping empty keys.
+func removeBlobs(blobs BlobStore, keys ...string) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if err := blobs.remove(key); err != nil {
+			log.Printf("error removing blob: %v", err)
+		}
+	}
+}
+
+// serveAttachment sends an attachment, or its thumbnail, to its uploader or
+// to a participant of the conversation it was sent in. Attachments of
+// deleted messages are gone.
+func serveAttachment(store Store, blobs BlobStore, w http.ResponseWriter, r *http.Request, userID int, thumbnail bool) {
+	log.Println(r.URL)
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, 400, "Invalid attachment id")
+		return
+	}
+
+	attachment, ok := readableAttachment(store, w, id, userID)
+	if !ok {
+		return
+	}
+
+	key, contentType := attachment.blobKey, attachment.ContentType
+	if thumbnail {
+		key, contentType = attachment.thumbnailKey, attachment.thumbnailContentType()
+	}
+
+	if key == "" {
+		writeJSONError(w, 404, "Attachment has no thumbnail")
+		return
+	}
+
+	blob, err := blobs.get(key)
+	if err != nil {
+		log.Printf("error reading attachment: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+	defer blob.Close()
+
+	disposition := "attachment"
+	if isImage(attachment.ContentType) {
+		disposition = "inline"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Name}))
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if !thumbnail {
+		w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	}
+
+	if _, err := io.Copy(w, blob); err != nil {
+		log.Printf("error sending attachment: %v", err)
+	}
+}
+
+// readableAttachment returns an attachment userID may download, writing an
+// error response and returning false if there is none.
+func readableAttachment(store Store, w http.ResponseWriter, id int64, userID int) (Attachment, bool) {
+	attachment, err := store.getAttachment(id)
+	if err == nil && attachment.uploaderID != userID && attachment.MessageID == 0 {
+		err = errNotFound
+	}
+
+	var message Message
+	if err == nil && attachment.MessageID != 0 {
+		message, err = store.getMessage(attachment.MessageID)
+		if err == nil && message.DeletedAt != 0 {
+			err = errNotFound
+		}
+	}
+
+	if err != nil {
+		if err != errNotFound {
+			log.Printf("error getting attachment: %v", err)
+			writeJSONError(w, 500, "Internal server error")
+			return attachment, false
+		}
+
+		writeJSONError(w, 404, "Attachment not found")
+		return attachment, false
+	}
+
+	if attachment.MessageID == 0 {
+		return attachment, true
+	}
+
+	visible, err := canReadMessage(store, userID, message)
+	if err != nil {
+		log.Printf("error checking room membership: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return attachment, false
+	}
+
+	if !visible {
+		writeJSONError(w, 403, "Not a participant of the conversation")
+		return attachment, false
+	}
+
+	return attachment, true
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How long a session token stays valid after login.
+const sessionTTL = 7 * 24 * time.Hour
+
+var (
+	errNoToken      = errors.New("no session token provided")
+	errInvalidToken = errors.New("invalid session token")
+	errTokenExpired = errors.New("session token expired")
+	errUserDeleted  = errors.New("user of the session token has been deleted")
+)
+
+// Authenticator issues and verifies HMAC-signed session tokens.
+type Authenticator struct {
+	// Key used for signing the tokens.
+	key []byte
+
+	// Lifetime of issued tokens.
+	ttl time.Duration
+
+	// Checked for the user of a token so that the tokens of deleted users
+	// stop working.
+	store Store
+}
+
+// sessionClaims is the signed payload of a session token.
+type sessionClaims struct {
+	UserID    int   `json:"uid"`
+	ExpiresAt int64 `json:"exp"`
+}
+
+func newAuthenticator(secret string, store Store) *Authenticator {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatal("error generating session key: ", err)
+		}
+		log.Printf("no session secret given, sessions will not survive a restart")
+	}
+
+	return &Authenticator{key: key, ttl: sessionTTL, store: store}
+}
+
+// issue creates a new session token for a user.
+func (a *Authenticator) issue(userID int) (string, error) {
+	payload, err := json.Marshal(sessionClaims{
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(a.ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	return encoded + "." + a.sign(encoded), nil
+}
+
+// verify checks the signature and expiry of a token and returns the user ID
+// it was issued for.
+func (a *Authenticator) verify(token string) (int, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return 0, errInvalidToken
+	}
+
+	if !hmac.Equal([]byte(parts[1]), []byte(a.sign(parts[0]))) {
+		return 0, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return 0, errInvalidToken
+	}
+
+	var claims sessionClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return 0, errInvalidToken
+	}
+
+	if time.Now().Unix() > claims.ExpiresAt {
+		return 0, errTokenExpired
+	}
+
+	return claims.UserID, nil
+}
+
+func (a *Authenticator) sign(data string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(data))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// authenticate returns the ID of the user making the request. The token is
+// read from the Authorization header, or from the token query parameter for
+// websocket upgrades where browsers cannot set headers.
+func (a *Authenticator) authenticate(r *http.Request) (int, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+
+	if token == "" {
+		return 0, errNoToken
+	}
+
+	userID, err := a.verify(token)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := a.store.getUser(userID); err != nil {
+		if err == errNotFound {
+			return 0, errUserDeleted
+		}
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// isTokenError checks whether authenticate failed because of the token
+// rather than the store.
+func isTokenError(err error) bool {
+	return err == errNoToken || err == errInvalidToken || err == errTokenExpired || err == errUserDeleted
+}
+
+// requireAuth wraps a handler so that it is only called for requests with a
+// valid session token.
+func (a *Authenticator) requireAuth(next func(w http.ResponseWriter, r *http.Request, userID int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := a.authenticate(r)
+		if err != nil {
+			if !isTokenError(err) {
+				log.Printf("error authenticating: %v", err)
+				writeJSONError(w, 500, "Internal server error")
+				return
+			}
+
+			writeJSONError(w, 401, "Unauthorized")
+			return
+		}
+
+		next(w, r, userID)
+	}
+}
+
+// serveLogin checks the email and password of a user and returns a new
+// session token.
+func serveLogin(store Store, auth *Authenticator, w http.ResponseWriter, r *http.Request) {
+	type LoginRequest struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	type LoginResponse struct {
+		Token string `json:"token"`
+		User  User   `json:"user"`
+	}
+
+	log.Println(r.URL)
+
+	if r.Method != "POST" {
+		writeJSONError(w, 405, "Method not allowed")
+		return
+	}
+
+	var login LoginRequest
+	if !readJSON(w, r, &login) {
+		return
+	}
+
+	user, err := store.getUserByEmail(login.Email)
+	if err != nil {
+		if err != errNotFound {
+			log.Printf("error getting user by email: %v", err)
+		}
+		writeJSONError(w, 401, "Invalid email or password")
+		return
+	}
+
+	valid, rehash := verifyPassword(user.Password, login.Password)
+	if !valid {
+		writeJSONError(w, 401, "Invalid email or password")
+		return
+	}
+
+	// Plaintext passwords from before hashing was introduced are migrated
+	// on their first successful login.
+	if rehash {
+		rehashPassword(store, user.ID, login.Password)
+	}
+
+	token, err := auth.issue(user.ID)
+	if err != nil {
+		log.Printf("error issuing session token: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	writeJSON(w, 200, LoginResponse{Token: token, User: user})
+}
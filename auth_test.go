@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionToken(t *testing.T) {
+	auth := &Authenticator{key: []byte("secret"), ttl: time.Hour}
+
+	token, err := auth.issue(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID, err := auth.verify(token)
+	if err != nil || userID != 42 {
+		t.Errorf("verify = %v, %v, want 42", userID, err)
+	}
+
+	other := &Authenticator{key: []byte("other secret"), ttl: time.Hour}
+	if _, err := other.verify(token); err != errInvalidToken {
+		t.Errorf("verify with another key: err = %v, want errInvalidToken", err)
+	}
+
+	// A payload swapped in under the old signature.
+	forged, _ := auth.issue(1)
+	tampered := strings.Split(forged, ".")[0] + "." + strings.Split(token, ".")[1]
+	if _, err := auth.verify(tampered); err != errInvalidToken {
+		t.Errorf("verify of a tampered token: err = %v, want errInvalidToken", err)
+	}
+
+	for _, malformed := range []string{"", "abc", "a.b.c", "!!!." + auth.sign("!!!")} {
+		if _, err := auth.verify(malformed); err != errInvalidToken {
+			t.Errorf("verify(%q): err = %v, want errInvalidToken", malformed, err)
+		}
+	}
+}
+
+func TestSessionTokenExpiry(t *testing.T) {
+	auth := &Authenticator{key: []byte("secret"), ttl: -time.Minute}
+
+	token, err := auth.issue(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := auth.verify(token); err != errTokenExpired {
+		t.Errorf("verify = %v, want errTokenExpired", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// BlobStore keeps uploaded files by key. Keys are generated by the server.
+type BlobStore interface {
+	put(key string, data []byte, contentType string) error
+	get(key string) (io.ReadCloser, error)
+	remove(key string) error
+}
+
+// newBlobStore returns the blob store selected in the config.
+func newBlobStore(cfg AttachmentsConfig) (BlobStore, error) {
+	if cfg.Store == "s3" {
+		return newS3BlobStore(cfg.S3), nil
+	}
+
+	return newLocalBlobStore(cfg.Dir)
+}
+
+// newBlobKey returns a random key for a new blob.
+func newBlobKey() (string, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(key), nil
+}
+
+// LocalBlobStore keeps blobs as files in a directory.
+type LocalBlobStore struct {
+	dir string
+}
+
+func newLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return &LocalBlobStore{dir: dir}, nil
+}
+
+// put writes the blob to a temporary file first so that a half written blob
+// is never read.
+func (s *LocalBlobStore) put(key string, data []byte, contentType string) error {
+	file, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), s.path(key))
+}
+
+func (s *LocalBlobStore) get(key string) (io.ReadCloser, error) {
+	file, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, errNotFound
+	}
+
+	return file, err
+}
+
+func (s *LocalBlobStore) remove(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *LocalBlobStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.Base(key))
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// ConversationSummary is a direct conversation in the /conversations
+// response: the peer with the unread count and the latest message.
+type ConversationSummary struct {
+	User
+	Unread      int      `json:"unread"`
+	LastMessage *Message `json:"last_message,omitempty"`
+}
+
+// RoomSummary is a room in the /conversations response.
+type RoomSummary struct {
+	Room
+	Unread      int      `json:"unread"`
+	LastMessage *Message `json:"last_message,omitempty"`
+}
+
+// serveConversations returns all rooms and conversations of the
+// authenticated user so that they can be displayed in the UI, each with its
+// unread count and latest message.
+func serveConversations(store Store, w http.ResponseWriter, r *http.Request, userID int) {
+	type UserConversationInfo struct {
+		Conversations []ConversationSummary `json:"conversations"`
+		Rooms         []RoomSummary         `json:"rooms"`
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	log.Println(r.URL)
+
+	if r.Method != "GET" {
+		writeJSONError(w, 405, "Method not allowed")
+		return
+	}
+
+	// Conversations with other users
+	conversations, err := store.conversations(userID)
+	if err != nil {
+		log.Printf("error getting user conversations: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	// Rooms user is in
+	rooms, err := store.userRooms(userID)
+	if err != nil {
+		log.Printf("error getting user rooms: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	// Unread counts and latest messages
+	states, err := store.conversationStates(userID)
+	if err != nil {
+		log.Printf("error getting conversation states: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	// Bundle user conversations and rooms into one JSON data
+	var conversationInfo UserConversationInfo
+	for _, peer := range conversations {
+		state := states[conversation{peerID: peer.ID}]
+		conversationInfo.Conversations = append(conversationInfo.Conversations, ConversationSummary{User: peer, Unread: state.unread, LastMessage: state.latest})
+	}
+
+	for _, room := range rooms {
+		state := states[conversation{roomID: room.ID}]
+		conversationInfo.Rooms = append(conversationInfo.Rooms, RoomSummary{Room: room, Unread: state.unread, LastMessage: state.latest})
+	}
+
+	conversationJSON, err := json.Marshal(conversationInfo)
+	if err != nil {
+		log.Printf("error converting conversations to JSON: %v", err)
+	}
+
+	// Return JSON for user
+	w.Write(conversationJSON)
+}
+
+// serveChatlog returns the history of a room given in room_id, or of the
+// direct messages between the authenticated user and receiver_id.
+func serveChatlog(store Store, w http.ResponseWriter, r *http.Request, userID int) {
+	type ChatlogJSON struct {
+		ID         int64  `json:"id"`
+		Sender     string `json:"sender"`
+		Receiver   string `json:"receiver"`
+		Message    string `json:"message"`
+		RoomID     int    `json:"room_id"`
+		Timestamp  int64  `json:"timestamp"`
+		EditedAt   int64  `json:"edited_at,omitempty"`
+		DeletedAt  int64  `json:"deleted_at,omitempty"`
+		ReplyTo    int64  `json:"reply_to,omitempty"`
+		ThreadRoot int64  `json:"thread_root,omitempty"`
+		Name       string `json:"name"`
+
+		Reactions []ReactionCount `json:"reactions,omitempty"`
+	}
+
+	log.Println(r.URL)
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var messages []Message
+	var err error
+
+	roomID, ok := r.URL.Query()["room_id"]
+	if !ok || len(roomID) < 1 {
+		receiverID, ok := r.URL.Query()["receiver_id"]
+		if !ok || len(receiverID) < 1 {
+			writeJSONError(w, 400, "Missing receiver_id")
+			return
+		}
+
+		peerID, convErr := strconv.Atoi(receiverID[0])
+		if convErr != nil {
+			writeJSONError(w, 400, "Invalid receiver_id")
+			return
+		}
+
+		messages, err = store.directMessages(userID, peerID)
+	} else {
+		id, convErr := strconv.Atoi(roomID[0])
+		if convErr != nil {
+			writeJSONError(w, 400, "Invalid room_id")
+			return
+		}
+
+		member, memberErr := isRoomMember(store, id, userID)
+		if memberErr != nil || !member {
+			writeJSONError(w, 403, "Not a member of the room")
+			return
+		}
+
+		messages, err = store.roomMessages(id)
+	}
+
+	if err != nil {
+		log.Printf("error reading chatlog: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	messageIDs := make([]int64, len(messages))
+	for i, message := range messages {
+		messageIDs[i] = message.ID
+	}
+
+	reactions, err := store.messageReactions(messageIDs)
+	if err != nil {
+		log.Printf("error reading reactions: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+	reactionCounts := countReactions(reactions, userID)
+
+	// Look up the name of every sender once.
+	names := make(map[string]string)
+	chatData := []ChatlogJSON{}
+	for _, message := range messages {
+		name, ok := names[message.Sender]
+		if !ok {
+			senderID, _ := strconv.Atoi(message.Sender)
+			if sender, err := store.getUser(senderID); err == nil {
+				name = sender.Name
+			}
+			names[message.Sender] = name
+		}
+
+		roomID, _ := strconv.Atoi(message.RoomID)
+		chatData = append(chatData, ChatlogJSON{
+			ID:         message.ID,
+			Sender:     message.Sender,
+			Receiver:   message.Receiver,
+			Message:    message.Message,
+			RoomID:     roomID,
+			Timestamp:  message.Timestamp,
+			EditedAt:   message.EditedAt,
+			DeletedAt:  message.DeletedAt,
+			ReplyTo:    message.ReplyTo,
+			ThreadRoot: message.ThreadRoot,
+			Name:       name,
+			Reactions:  reactionCounts[message.ID],
+		})
+	}
+
+	writeJSON(w, 200, chatData)
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -23,9 +24,6 @@ const (
 
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
 )
 
 var (
@@ -33,10 +31,8 @@ var (
 	space   = []byte{' '}
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
+// upgrader gets its buffer sizes from the config in main.
+var upgrader = websocket.Upgrader{}
 
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
@@ -48,17 +44,73 @@ type Client struct {
 	// Buffered channel of outbound messages.
 	send chan []byte
 
-	// The database connection.
-	dbconn *HalooDB
+	// ID of the user this connection belongs to.
+	userID int
+
+	// Rooms the client is subscribed to. Only accessed by the hub.
+	rooms map[int]bool
+
+	// Holds one value for every message waiting for an ack. When it is full
+	// the client is not read from until acks arrive.
+	inflight chan bool
+
+	// Closed by the hub when it drops the client.
+	gone chan bool
+
+	// Whether the device set itself away and when the client last sent
+	// something. Only accessed by the hub.
+	away       bool
+	lastActive time.Time
+
+	// Start of the current rate limit window and typing frames sent in it.
+	// Only accessed by the hub.
+	typingWindow time.Time
+	typingFrames int
+
+	// Set until a client that connected with resume=1 has resumed, or
+	// resumeTimeout passes. Frames held back meanwhile, conversations with
+	// frames dropped past heldLimit, and the newest message of each
+	// conversation it has got in the replay. Only accessed by the hub.
+	resuming bool
+	held     []heldFrame
+	dropped  map[conversation]bool
+	replayed map[conversation]messageCursor
+
+	// Rooms subscribed to for a resume frame before its missed messages were
+	// read, unsubscribed again if the resume fails. Only accessed by the
+	// hub.
+	resumeRooms []int
+
+	// Close frame sent after send is closed. Set by the hub before it closes
+	// send, empty unless the server is shutting down or the user has been
+	// deleted.
+	closeMessage []byte
 }
 
 // Message is the message a client sends.
 type Message struct {
+	ID        int64  `json:"id,omitempty"`
 	Sender    string `json:"sender"`
 	Receiver  string `json:"receiver"`
 	Message   string `json:"message"`
 	RoomID    string `json:"room_id,omitempty"`
 	Timestamp int64  `json:"timestamp"`
+
+	// When the message was last edited or deleted, in milliseconds. A
+	// deleted message has no text.
+	EditedAt  int64 `json:"edited_at,omitempty"`
+	DeletedAt int64 `json:"deleted_at,omitempty"`
+
+	// Message this one replies to and the first message of its thread. The
+	// thread root is set by the server.
+	ReplyTo    int64 `json:"reply_to,omitempty"`
+	ThreadRoot int64 `json:"thread_root,omitempty"`
+
+	// Replies to a thread root, filled in for history.
+	Thread *ThreadSummary `json:"thread,omitempty"`
+
+	// Uploaded files sent with the message. Clients only give their IDs.
+	Attachments []Attachment `json:"attachments,omitempty"`
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -71,7 +123,7 @@ func (c *Client) readPump() {
 		c.hub.unregister <- c
 		c.conn.Close()
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadLimit(int64(config.Limits.MaxMessageSize))
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
@@ -85,14 +137,26 @@ func (c *Client) readPump() {
 
 		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
 
-		c.hub.broadcast <- message
+		var envelope Envelope
+		if err := json.Unmarshal(message, &envelope); err != nil {
+			c.hub.inbound <- inbound{client: c, problem: protocolError(errorBadRequest, "Invalid JSON")}
+			continue
+		}
+
+		// Never trust the sender given by the client.
+		if envelope.Message != nil {
+			envelope.Message.Sender = strconv.Itoa(c.userID)
+		}
 
-		var jsonMessage Message
-		if err := json.Unmarshal(message, &jsonMessage); err != nil {
-			log.Printf("error: %v", err)
+		if envelope.Type == typeMessage {
+			select {
+			case c.inflight <- true:
+			case <-c.gone:
+				return
+			}
 		}
 
-		c.dbconn.queue <- jsonMessage
+		c.hub.inbound <- c.hub.prepare(c, envelope)
 	}
 }
 
@@ -106,6 +170,7 @@ func (c *Client) writePump() {
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		c.hub.writers.Done()
 	}()
 	for {
 		select {
@@ -113,7 +178,7 @@ func (c *Client) writePump() {
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage)
 				return
 			}
 
@@ -143,13 +208,30 @@ func (c *Client) writePump() {
 }
 
 // serveWs handles websocket requests from the peer.
-func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+func serveWs(hub *Hub, auth *Authenticator, w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.authenticate(r)
+	if err != nil {
+		if !isTokenError(err) {
+			log.Printf("error authenticating: %v", err)
+			http.Error(w, "Internal server error", 500)
+			return
+		}
+
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), dbconn: hub.dbconn}
+	client := &Client{hub: hub, conn: conn, send: make(chan []byte, config.Limits.SendBufferSize), userID: userID, rooms: make(map[int]bool), inflight: make(chan bool, config.Limits.MaxInFlight), gone: make(chan bool)}
+	if r.URL.Query().Get("resume") == "1" {
+		client.resuming = true
+		client.dropped = make(map[conversation]bool)
+	}
+	client.hub.writers.Add(1)
 	client.hub.register <- client
 
 	// Allow collection of memory referenced by the caller by doing all work in
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EmbeddedCockroach is a single node CockroachDB started by the server for
+// development. Its output is streamed to the server log.
+type EmbeddedCockroach struct {
+	cmd *exec.Cmd
+
+	// Closed once the process has exited, after err is set to its result.
+	done chan bool
+	err  error
+}
+
+// startEmbeddedCockroach starts the cockroach binary and waits until the
+// node reports itself ready and the database of the DSN exists.
+func startEmbeddedCockroach(cfg DatabaseConfig) (*EmbeddedCockroach, error) {
+	path := filepath.FromSlash(cfg.CockroachPath)
+
+	cmd := exec.Command(path, "start-single-node", "--insecure",
+		"--store="+cfg.DataDir,
+		"--listen-addr="+cfg.ListenAddr,
+		"--http-addr="+cfg.HTTPAddr)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting %s: %v", path, err)
+	}
+
+	c := &EmbeddedCockroach{cmd: cmd, done: make(chan bool)}
+
+	// Wait must only be called once both pipes have been read to the end.
+	var streams sync.WaitGroup
+	streams.Add(2)
+	go streamLog(stdout, &streams)
+	go streamLog(stderr, &streams)
+
+	go func() {
+		streams.Wait()
+		c.err = cmd.Wait()
+		close(c.done)
+	}()
+
+	log.Printf("waiting for the embedded database at %s", cfg.ListenAddr)
+	if err := c.waitReady(cfg.HTTPAddr, time.Duration(cfg.StartupTimeoutSeconds)*time.Second); err != nil {
+		c.stop()
+		return nil, err
+	}
+
+	if err := c.createDatabase(cfg); err != nil {
+		c.stop()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// streamLog copies the output of the database to the server log line by
+// line until the output is closed.
+func streamLog(r io.Reader, streams *sync.WaitGroup) {
+	defer streams.Done()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		log.Printf("cockroach: %s", scanner.Text())
+	}
+
+	// Keep reading so that the process does not block on a full pipe after
+	// an overlong line.
+	io.Copy(io.Discard, r)
+}
+
+// waitReady polls the health endpoint of the node until it is ready to
+// accept SQL connections.
+func (c *EmbeddedCockroach) waitReady(httpAddr string, timeout time.Duration) error {
+	client := http.Client{Timeout: time.Second}
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		select {
+		case <-c.done:
+			return fmt.Errorf("embedded database exited during startup: %v", c.err)
+		default:
+		}
+
+		resp, err := client.Get("http://" + httpAddr + "/health?ready=1")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == 200 {
+				return nil
+			}
+		}
+
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	return errors.New("embedded database did not become ready in time")
+}
+
+// createDatabase creates the database named in the DSN if it is missing.
+func (c *EmbeddedCockroach) createDatabase(cfg DatabaseConfig) error {
+	dsn, err := url.Parse(cfg.DSN)
+	if err != nil {
+		return fmt.Errorf("invalid database dsn: %v", err)
+	}
+
+	name := strings.TrimPrefix(dsn.Path, "/")
+	if name == "" {
+		return nil
+	}
+
+	out, err := exec.Command(filepath.FromSlash(cfg.CockroachPath), "sql", "--insecure",
+		"--host="+cfg.ListenAddr,
+		"--execute=CREATE DATABASE IF NOT EXISTS "+name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error creating database %s: %v: %s", name, err, out)
+	}
+
+	return nil
+}
+
+// stop asks the node to shut down and kills it if it has not exited within
+// ten seconds. Nothing is done if it has already exited.
+func (c *EmbeddedCockroach) stop() {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	if runtime.GOOS == "windows" {
+		c.cmd.Process.Kill()
+	} else {
+		c.cmd.Process.Signal(os.Interrupt)
+	}
+
+	select {
+	case <-c.done:
+	case <-time.After(10 * time.Second):
+		log.Printf("embedded database did not stop, killing it")
+		c.cmd.Process.Kill()
+		<-c.done
+	}
+
+	log.Printf("embedded database stopped")
+}
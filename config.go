@@ -0,0 +1,481 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Config file used when -config and HALOO_CONFIG are not given, if it exists.
+const defaultConfigFile = "haloo-chat.toml"
+
+// Prefix of the environment variables overriding the config file.
+const envPrefix = "HALOO"
+
+// Config holds all settings of the server. The values are resolved from, in
+// increasing order of precedence: the defaults, the config file, HALOO_*
+// environment variables and command line flags.
+type Config struct {
+	// HTTP service address.
+	Addr string `toml:"addr"`
+
+	// Where data is kept: postgres or memory.
+	Store string `toml:"store"`
+
+	// Secret key for signing session tokens.
+	Secret string `toml:"secret"`
+
+	Database DatabaseConfig `toml:"database"`
+	TLS      TLSConfig      `toml:"tls"`
+	Limits   LimitsConfig   `toml:"limits"`
+	Static   StaticConfig   `toml:"static"`
+	Features FeaturesConfig `toml:"features"`
+	Shutdown ShutdownConfig `toml:"shutdown"`
+	Presence PresenceConfig `toml:"presence"`
+	Typing   TypingConfig   `toml:"typing"`
+
+	Attachments AttachmentsConfig `toml:"attachments"`
+	Pictures    PicturesConfig    `toml:"pictures"`
+}
+
+// DatabaseConfig configures the CockroachDB/PostgreSQL store.
+type DatabaseConfig struct {
+	// external connects to a database running elsewhere, embedded starts a
+	// single node CockroachDB for development.
+	Mode string `toml:"mode"`
+
+	DSN           string `toml:"dsn"`
+	MigrationsDir string `toml:"migrations_dir"`
+
+	// Connection pool settings.
+	MaxOpenConns           int `toml:"max_open_conns"`
+	MaxIdleConns           int `toml:"max_idle_conns"`
+	ConnMaxLifetimeSeconds int `toml:"conn_max_lifetime_seconds"`
+
+	// How many times and how often to retry connecting on startup.
+	ConnectRetries              int `toml:"connect_retries"`
+	ConnectRetryIntervalSeconds int `toml:"connect_retry_interval_seconds"`
+
+	// Embedded mode settings.
+	CockroachPath         string `toml:"cockroach_path"`
+	DataDir               string `toml:"data_dir"`
+	ListenAddr            string `toml:"listen_addr"`
+	HTTPAddr              string `toml:"http_addr"`
+	StartupTimeoutSeconds int    `toml:"startup_timeout_seconds"`
+
+	// Run pending migrations and create the default data on startup.
+	Migrate bool `toml:"migrate"`
+}
+
+// TLSConfig enables HTTPS when both files are set.
+type TLSConfig struct {
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+}
+
+// LimitsConfig holds buffer sizes and limits.
+type LimitsConfig struct {
+	// Maximum size of a websocket frame read from a client.
+	MaxMessageSize int `toml:"max_message_size"`
+
+	// Websocket I/O buffer sizes.
+	ReadBufferSize  int `toml:"read_buffer_size"`
+	WriteBufferSize int `toml:"write_buffer_size"`
+
+	// Frames buffered for a client before it is dropped as too slow.
+	SendBufferSize int `toml:"send_buffer_size"`
+
+	// Messages a client can have waiting for an ack.
+	MaxInFlight int `toml:"max_in_flight"`
+
+	// Persistence queue size, batch size and retries.
+	QueueSize    int `toml:"queue_size"`
+	MaxBatchSize int `toml:"max_batch_size"`
+	MaxRetries   int `toml:"max_retries"`
+
+	// bcrypt cost used for hashing passwords.
+	BcryptCost int `toml:"bcrypt_cost"`
+
+	// Default and maximum number of messages in a history page.
+	HistoryLimit    int `toml:"history_limit"`
+	MaxHistoryLimit int `toml:"max_history_limit"`
+}
+
+// StaticConfig points to the built web client.
+type StaticConfig struct {
+	IndexFile string `toml:"index_file"`
+	AssetsDir string `toml:"assets_dir"`
+}
+
+// FeaturesConfig turns optional features on and off.
+type FeaturesConfig struct {
+	// Allow anyone to register with POST /users.
+	Registration bool `toml:"registration"`
+
+	// Allow users to create rooms with POST /rooms.
+	RoomCreation bool `toml:"room_creation"`
+
+	// Seed the in-memory store with the default data.
+	SeedMemoryStore bool `toml:"seed_memory_store"`
+}
+
+// ShutdownConfig configures how the server stops on SIGINT and SIGTERM.
+type ShutdownConfig struct {
+	// Time allowed for saving queued messages and closing the clients.
+	TimeoutSeconds int `toml:"timeout_seconds"`
+
+	// Delay the clients are told to wait before reconnecting.
+	ReconnectAfterSeconds int `toml:"reconnect_after_seconds"`
+}
+
+// PresenceConfig configures presence tracking.
+type PresenceConfig struct {
+	// A device without activity for this long is away.
+	AwayAfterSeconds int `toml:"away_after_seconds"`
+}
+
+// TypingConfig configures typing indicators.
+type TypingConfig struct {
+	// Typing stops if no new typing_start arrives in this time.
+	TimeoutSeconds int `toml:"timeout_seconds"`
+
+	// Typing frames a client may send in a minute.
+	MaxPerMinute int `toml:"max_per_minute"`
+}
+
+// AttachmentsConfig configures file uploads and where they are kept.
+type AttachmentsConfig struct {
+	// Blob store for the files: local or s3.
+	Store string `toml:"store"`
+
+	// Directory of the local blob store.
+	Dir string `toml:"dir"`
+
+	// Largest file that can be uploaded.
+	MaxSizeBytes int `toml:"max_size_bytes"`
+
+	// Images are scaled down to fit this many pixels in both directions for
+	// their thumbnails.
+	ThumbnailSize int `toml:"thumbnail_size"`
+
+	// Uploads not sent in a message within this time are removed.
+	UnsentExpirySeconds int `toml:"unsent_expiry_seconds"`
+
+	S3 S3Config `toml:"s3"`
+}
+
+// S3Config points to an S3 compatible bucket. Objects are addressed in path
+// style, endpoint/bucket/key, which also works with local stand-ins.
+type S3Config struct {
+	Endpoint  string `toml:"endpoint"`
+	Region    string `toml:"region"`
+	Bucket    string `toml:"bucket"`
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+}
+
+// PicturesConfig configures profile and room picture uploads.
+type PicturesConfig struct {
+	// Directory the scaled pictures are kept in.
+	Dir string `toml:"dir"`
+
+	// Largest picture that can be uploaded.
+	MaxSizeBytes int `toml:"max_size_bytes"`
+}
+
+// config is the effective configuration, set by main before anything else
+// starts.
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Addr:  ":8000",
+		Store: "postgres",
+		Database: DatabaseConfig{
+			Mode:                        "external",
+			DSN:                         "postgresql://root@localhost:26257/haloochat?sslmode=disable",
+			MigrationsDir:               "./database/migrations",
+			MaxOpenConns:                20,
+			MaxIdleConns:                5,
+			ConnMaxLifetimeSeconds:      300,
+			ConnectRetries:              10,
+			ConnectRetryIntervalSeconds: 2,
+			CockroachPath:               "./bin/cockroach",
+			DataDir:                     "./cockroach-data",
+			ListenAddr:                  "localhost:26257",
+			HTTPAddr:                    "localhost:8080",
+			StartupTimeoutSeconds:       30,
+		},
+		Limits: LimitsConfig{
+			MaxMessageSize:  512,
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			SendBufferSize:  256,
+			MaxInFlight:     32,
+			QueueSize:       1024,
+			MaxBatchSize:    64,
+			MaxRetries:      5,
+			BcryptCost:      bcrypt.DefaultCost,
+			HistoryLimit:    50,
+			MaxHistoryLimit: 100,
+		},
+		Static: StaticConfig{
+			IndexFile: "public/build/index.html",
+			AssetsDir: "public/build/static",
+		},
+		Features: FeaturesConfig{
+			Registration:    true,
+			RoomCreation:    true,
+			SeedMemoryStore: true,
+		},
+		Shutdown: ShutdownConfig{
+			TimeoutSeconds:        15,
+			ReconnectAfterSeconds: 5,
+		},
+		Presence: PresenceConfig{
+			AwayAfterSeconds: 300,
+		},
+		Typing: TypingConfig{
+			TimeoutSeconds: 6,
+			MaxPerMinute:   60,
+		},
+		Attachments: AttachmentsConfig{
+			Store:               "local",
+			Dir:                 "./attachments",
+			MaxSizeBytes:        10 << 20,
+			ThumbnailSize:       320,
+			UnsentExpirySeconds: 86400,
+			S3: S3Config{
+				Region: "us-east-1",
+			},
+		},
+		Pictures: PicturesConfig{
+			Dir:          "./pictures",
+			MaxSizeBytes: 5 << 20,
+		},
+	}
+}
+
+// Command line flags. They only override the config when given explicitly.
+var (
+	configFile = flag.String("config", "", "path to the config file (default "+defaultConfigFile+" if it exists)")
+	addrFlag   = flag.String("addr", ":8000", "http service address")
+	storeFlag  = flag.String("store", "postgres", "where data is kept: postgres or memory")
+	secretFlag = flag.String("secret", "", "secret key for signing session tokens")
+	dsnFlag    = flag.String("dsn", "", "database connection string")
+	costFlag   = flag.Int("bcrypt-cost", bcrypt.DefaultCost, "bcrypt cost used for hashing passwords")
+	migrate    = flag.Bool("migrate", false, "Whether or not you want to run the pending database migrations and create the default data on startup.")
+)
+
+// loadConfig resolves the effective config. flag.Parse must have been
+// called.
+func loadConfig() (*Config, error) {
+	cfg := defaultConfig()
+
+	path := *configFile
+	if path == "" {
+		path = os.Getenv(envPrefix + "_CONFIG")
+	}
+
+	if path != "" {
+		if _, err := toml.DecodeFile(path, cfg); err != nil {
+			return nil, fmt.Errorf("error reading config file %s: %v", path, err)
+		}
+	} else if _, err := os.Stat(defaultConfigFile); err == nil {
+		if _, err := toml.DecodeFile(defaultConfigFile, cfg); err != nil {
+			return nil, fmt.Errorf("error reading config file %s: %v", defaultConfigFile, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(cfg).Elem(), envPrefix); err != nil {
+		return nil, err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Addr = *addrFlag
+		case "store":
+			cfg.Store = *storeFlag
+		case "secret":
+			cfg.Secret = *secretFlag
+		case "dsn":
+			cfg.Database.DSN = *dsnFlag
+		case "bcrypt-cost":
+			cfg.Limits.BcryptCost = *costFlag
+		case "migrate":
+			cfg.Database.Migrate = *migrate
+		}
+	})
+
+	return cfg, cfg.validate()
+}
+
+// applyEnv overrides config fields from environment variables named after
+// their TOML keys, for example HALOO_LIMITS_QUEUE_SIZE.
+func applyEnv(v reflect.Value, prefix string) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		name := prefix + "_" + strings.ToUpper(v.Type().Field(i).Tag.Get("toml"))
+
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s must be an integer", name)
+			}
+			field.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s must be true or false", name)
+			}
+			field.SetBool(b)
+		}
+	}
+
+	return nil
+}
+
+// validate checks that the config is usable.
+func (cfg *Config) validate() error {
+	if cfg.Addr == "" {
+		return errors.New("addr must be set")
+	}
+
+	switch cfg.Store {
+	case "postgres":
+		if cfg.Database.DSN == "" {
+			return errors.New("database.dsn must be set when store is postgres")
+		}
+	case "memory":
+	default:
+		return fmt.Errorf("unknown store %q, expected postgres or memory", cfg.Store)
+	}
+
+	switch cfg.Database.Mode {
+	case "external":
+	case "embedded":
+		if cfg.Database.CockroachPath == "" || cfg.Database.DataDir == "" {
+			return errors.New("database.cockroach_path and database.data_dir must be set in embedded mode")
+		}
+	default:
+		return fmt.Errorf("unknown database.mode %q, expected external or embedded", cfg.Database.Mode)
+	}
+
+	if cfg.Database.MaxOpenConns < 1 || cfg.Database.MaxIdleConns < 0 || cfg.Database.ConnMaxLifetimeSeconds < 0 {
+		return errors.New("database pool settings must not be negative and max_open_conns must be positive")
+	}
+
+	if cfg.Database.ConnectRetries < 0 || cfg.Database.ConnectRetryIntervalSeconds < 0 || cfg.Database.StartupTimeoutSeconds < 1 {
+		return errors.New("database retry settings must not be negative and startup_timeout_seconds must be positive")
+	}
+
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return errors.New("tls.cert_file and tls.key_file must be set together")
+	}
+
+	for _, file := range []string{cfg.TLS.CertFile, cfg.TLS.KeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("tls file %s: %v", file, err)
+		}
+	}
+
+	limits := reflect.ValueOf(cfg.Limits)
+	for i := 0; i < limits.NumField(); i++ {
+		if limits.Field(i).Int() < 1 {
+			return fmt.Errorf("limits.%s must be positive", limits.Type().Field(i).Tag.Get("toml"))
+		}
+	}
+
+	if cfg.Limits.BcryptCost < bcrypt.MinCost || cfg.Limits.BcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("limits.bcrypt_cost must be between %v and %v", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	if cfg.Limits.HistoryLimit > cfg.Limits.MaxHistoryLimit {
+		return errors.New("limits.history_limit must not exceed limits.max_history_limit")
+	}
+
+	if cfg.Shutdown.TimeoutSeconds < 1 || cfg.Shutdown.ReconnectAfterSeconds < 0 {
+		return errors.New("shutdown.timeout_seconds must be positive and shutdown.reconnect_after_seconds must not be negative")
+	}
+
+	if cfg.Presence.AwayAfterSeconds < 1 {
+		return errors.New("presence.away_after_seconds must be positive")
+	}
+
+	if cfg.Typing.TimeoutSeconds < 1 || cfg.Typing.MaxPerMinute < 1 {
+		return errors.New("typing.timeout_seconds and typing.max_per_minute must be positive")
+	}
+
+	switch cfg.Attachments.Store {
+	case "local":
+		if cfg.Attachments.Dir == "" {
+			return errors.New("attachments.dir must be set when attachments.store is local")
+		}
+	case "s3":
+		if cfg.Attachments.S3.Endpoint == "" || cfg.Attachments.S3.Region == "" || cfg.Attachments.S3.Bucket == "" {
+			return errors.New("attachments.s3.endpoint, region and bucket must be set when attachments.store is s3")
+		}
+		if _, err := url.Parse(cfg.Attachments.S3.Endpoint); err != nil {
+			return fmt.Errorf("attachments.s3.endpoint: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown attachments.store %q, expected local or s3", cfg.Attachments.Store)
+	}
+
+	if cfg.Attachments.MaxSizeBytes < 1 || cfg.Attachments.ThumbnailSize < 1 || cfg.Attachments.UnsentExpirySeconds < 1 {
+		return errors.New("attachments.max_size_bytes, attachments.thumbnail_size and attachments.unsent_expiry_seconds must be positive")
+	}
+
+	if cfg.Pictures.Dir == "" || cfg.Pictures.MaxSizeBytes < 1 {
+		return errors.New("pictures.dir must be set and pictures.max_size_bytes must be positive")
+	}
+
+	return nil
+}
+
+// print writes the config as TOML with the secret hidden.
+func (cfg *Config) print() error {
+	shown := *cfg
+	if shown.Secret != "" {
+		shown.Secret = "<hidden>"
+	}
+	if shown.Attachments.S3.SecretKey != "" {
+		shown.Attachments.S3.SecretKey = "<hidden>"
+	}
+
+	if dsn, err := url.Parse(shown.Database.DSN); err == nil && dsn.User != nil {
+		if _, ok := dsn.User.Password(); ok {
+			dsn.User = url.UserPassword(dsn.User.Username(), "hidden")
+			shown.Database.DSN = dsn.String()
+		}
+	}
+
+	return toml.NewEncoder(os.Stdout).Encode(shown)
+}
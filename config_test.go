@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeConfigFile writes a config file for loadConfig to pick up through
+// HALOO_CONFIG.
+func writeConfigFile(t *testing.T, contents string) {
+	path := filepath.Join(t.TempDir(), "haloo-chat.toml")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("HALOO_CONFIG", path)
+}
+
+// The file overrides the defaults, the environment overrides the file and
+// explicit flags override both.
+func TestLoadConfigPrecedence(t *testing.T) {
+	writeConfigFile(t, `
+addr = ":1000"
+store = "memory"
+
+[limits]
+queue_size = 10
+send_buffer_size = 20
+`)
+	t.Setenv("HALOO_ADDR", ":2000")
+	t.Setenv("HALOO_LIMITS_QUEUE_SIZE", "11")
+
+	if err := flag.Set("addr", ":3000"); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("addr", defaultConfig().Addr)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Addr != ":3000" {
+		t.Errorf("Addr = %q, want the flag", cfg.Addr)
+	}
+	if cfg.Limits.QueueSize != 11 {
+		t.Errorf("QueueSize = %v, want the environment", cfg.Limits.QueueSize)
+	}
+	if cfg.Limits.SendBufferSize != 20 || cfg.Store != "memory" {
+		t.Errorf("SendBufferSize = %v, Store = %q, want the file", cfg.Limits.SendBufferSize, cfg.Store)
+	}
+	if cfg.Limits.MaxBatchSize != defaultConfig().Limits.MaxBatchSize {
+		t.Errorf("MaxBatchSize = %v, want the default", cfg.Limits.MaxBatchSize)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	writeConfigFile(t, `store = "memory"`)
+
+	t.Setenv("HALOO_LIMITS_QUEUE_SIZE", "many")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loading a non-integer queue size succeeded")
+	}
+
+	t.Setenv("HALOO_LIMITS_QUEUE_SIZE", "0")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loading a zero queue size succeeded")
+	}
+}
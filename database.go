@@ -4,11 +4,8 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"os/exec"
-	"runtime"
-	"strconv"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -18,48 +15,91 @@ type HalooDB struct {
 	// The database connection.
 	connection *sql.DB
 
-	// The database insertion queue channel
-	queue chan Message
+	// Database started by the server in embedded mode.
+	embedded *EmbeddedCockroach
 
-	// Whether or not to run the initial migration
+	// Whether or not to run the pending migrations on startup
 	runMigration bool
 }
 
 func newHalooDB(migrate bool) *HalooDB {
 	return &HalooDB{
-		queue:        make(chan Message),
 		runMigration: migrate,
 	}
 }
 
-func (hdb *HalooDB) connect() {
-	// Connect to the "haloochat" database.
-	db, err := sql.Open("postgres", "postgresql://root@localhost:26257/haloochat?sslmode=disable")
+// connect starts the embedded database if configured and opens the
+// connection pool, retrying until the database answers.
+func (hdb *HalooDB) connect() error {
+	cfg := config.Database
+
+	if cfg.Mode == "embedded" {
+		embedded, err := startEmbeddedCockroach(cfg)
+		if err != nil {
+			return err
+		}
+		hdb.embedded = embedded
+	}
+
+	db, err := sql.Open("postgres", cfg.DSN)
 	if err != nil {
-		log.Fatal("error connecting to the database: ", err)
+		hdb.close()
+		return fmt.Errorf("error connecting to the database: %v", err)
 	}
 
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetimeSeconds) * time.Second)
 	hdb.connection = db
-	go hdb.start()
+
+	for attempt := 1; ; attempt++ {
+		err = db.Ping()
+		if err == nil {
+			break
+		}
+
+		if attempt > cfg.ConnectRetries {
+			hdb.close()
+			return fmt.Errorf("error connecting to the database: %v", err)
+		}
+
+		log.Printf("database not available yet, retrying: %v", err)
+		time.Sleep(time.Duration(cfg.ConnectRetryIntervalSeconds) * time.Second)
+	}
+
 	if hdb.runMigration {
 		hdb.migrate()
-		err = hdb.test()
 
-		if err == nil {
-			fmt.Println("*** DATABASE TESTED AND WORKING ***")
+		if err := hdb.test(); err == nil {
+			log.Printf("database tested and working")
 		}
 	}
 
-	fmt.Println("*** HALOO CHAT RUNNING! :) ***")
+	return nil
+}
+
+// close closes the connection pool and stops the embedded database.
+func (hdb *HalooDB) close() {
+	if hdb.connection != nil {
+		hdb.connection.Close()
+	}
+
+	if hdb.embedded != nil {
+		hdb.embedded.stop()
+		hdb.embedded = nil
+	}
 }
 
 // Test the database
 func (hdb *HalooDB) test() error {
-	var err error
+	hash, err := hashPassword("password")
+	if err != nil {
+		return err
+	}
 
 	// Insert test user into the users table.
 	if _, err = hdb.connection.Exec(
-		"INSERT INTO chat_users (name, email, password, last_seen, profile_picture) VALUES ('Testuser', 'test@gmail.com', 'password', '2016-01-25 10:10:10.555555-05:00', 'test.jpg')"); err != nil {
+		"INSERT INTO chat_users (name, email, password, last_seen, profile_picture) VALUES ('Testuser', 'test@gmail.com', $1, '2016-01-25 10:10:10.555555-05:00', 'test.jpg')", hash); err != nil {
 		log.Printf("error inserting to users: %v", err)
 	}
 
@@ -100,88 +140,17 @@ func (hdb *HalooDB) rowCount(table string) int {
 	return count
 }
 
-func (hdb *HalooDB) queuePump() {
-	for {
-		select {
-		case message := <-hdb.queue:
-			if message.RoomID == "" {
-				stmt, err := hdb.connection.Prepare("INSERT INTO chatlog (sender, receiver, message, room_id, timestamp) VALUES ($1, $2, $3, null, $4)")
-
-				if err != nil {
-					log.Printf("error preparing message to db: %v", err)
-				}
-
-				senderID, err := strconv.Atoi(message.Sender)
-				if err != nil {
-					log.Printf("error converting senderId to int: %v", err)
-				}
-
-				receiverID, err := strconv.Atoi(message.Receiver)
-				if err != nil {
-					log.Printf("error converting receiverId to int: %v", err)
-				}
-
-				_, err = stmt.Exec(senderID, receiverID, message.Message, message.Timestamp)
-				if err != nil {
-					log.Printf("error inserting message to db: %v", err)
-				}
-			} else {
-				stmt, err := hdb.connection.Prepare("INSERT INTO chatlog (sender, receiver, message, room_id, timestamp) VALUES ($1, $2, $3, $4, $5)")
-
-				if err != nil {
-					log.Printf("error preparing message to db: %v", err)
-				}
-
-				senderID, err := strconv.Atoi(message.Sender)
-				if err != nil {
-					log.Printf("error converting senderId to int: %v", err)
-				}
-
-				receiverID, err := strconv.Atoi(message.Receiver)
-				if err != nil {
-					log.Printf("error converting receiverId to int: %v", err)
-				}
-
-				roomID, err := strconv.Atoi(message.RoomID)
-				if err != nil {
-					log.Printf("error converting roomId to int: %v", err)
-				}
-
-				_, err = stmt.Exec(senderID, receiverID, message.Message, roomID, message.Timestamp)
-				if err != nil {
-					log.Printf("error inserting message to db: %v", err)
-				}
-			}
-		}
-	}
-}
-
-func (hdb *HalooDB) start() {
-	var err error
-	if runtime.GOOS == "windows" {
-		cmd := exec.Command("./bin/.\\cockroach", "start", "--insecure")
-		err = cmd.Start()
-	} else if runtime.GOOS == "darwin" || runtime.GOOS == "linux" {
-		cmd := exec.Command("./bin/cockroach", "start", "--insecure")
-		err = cmd.Start()
-	}
-
-	if err != nil {
-		log.Printf("Command finished with error: %v", err)
-	}
-}
-
+// migrate applies all pending migrations and creates the default data.
 func (hdb *HalooDB) migrate() {
-	data, err := ioutil.ReadFile("./database/migration.sql")
+	mg, err := newMigrator(hdb.connection, config.Database.MigrationsDir)
 	if err != nil {
-		log.Printf("error reading migration file: %v", err)
+		log.Printf("error reading migrations: %v", err)
+		return
 	}
 
-	dataStr := string(data)
-
-	_, err = hdb.connection.Exec(dataStr)
-	if err != nil {
-		log.Printf("error executing the migration: %v", err)
+	if err := mg.up(); err != nil {
+		log.Printf("error executing the migrations: %v", err)
+		return
 	}
 
 	defer hdb.createDefaultData()
@@ -194,14 +163,24 @@ func (hdb *HalooDB) createDefaultData() {
 	var roomID int
 
 	if hdb.rowCount("chat_users") == 0 {
+		hash, err := hashPassword("password")
+		if err != nil {
+			log.Printf("error hashing default user password: %v", err)
+		}
+
+		hashTwo, err := hashPassword("password2")
+		if err != nil {
+			log.Printf("error hashing default user password: %v", err)
+		}
+
 		// Insert default user into users table.
 		if err := hdb.connection.QueryRow(
-			"INSERT INTO chat_users (name, email, password, last_seen, profile_picture) VALUES ('Superadmin', 'admin@haloochat.dev', 'password', '2017-10-25 10:10:10.555555-05:00', 'admin.jpg') RETURNING id").Scan(&userID); err != nil {
+			"INSERT INTO chat_users (name, email, password, last_seen, profile_picture) VALUES ('Superadmin', 'admin@haloochat.dev', $1, '2017-10-25 10:10:10.555555-05:00', 'admin.jpg') RETURNING id", hash).Scan(&userID); err != nil {
 			log.Printf("error inserting default user into users: %v", err)
 		}
 
 		if err := hdb.connection.QueryRow(
-			"INSERT INTO chat_users (name, email, password, last_seen, profile_picture) VALUES ('Superadmin2', 'admin2@haloochat.dev', 'password2', '2017-10-25 10:10:10.555555-05:00', 'admin2.jpg') RETURNING id").Scan(&userTwoID); err != nil {
+			"INSERT INTO chat_users (name, email, password, last_seen, profile_picture) VALUES ('Superadmin2', 'admin2@haloochat.dev', $1, '2017-10-25 10:10:10.555555-05:00', 'admin2.jpg') RETURNING id", hashTwo).Scan(&userTwoID); err != nil {
 			log.Printf("error inserting default user into users: %v", err)
 		}
 	}
@@ -235,18 +214,18 @@ func (hdb *HalooDB) createDefaultData() {
 		}
 	}
 
-	stmt, err := hdb.connection.Prepare("INSERT INTO chatlog (sender, receiver, message, room_id, timestamp) VALUES ($1, $2, $3, $4, $5)")
+	stmt, err := hdb.connection.Prepare("INSERT INTO chatlog (sender, receiver, message, room_id, timestamp, created_at) VALUES ($1, null, $2, $3, $4, to_timestamp($4::FLOAT8 / 1000))")
 
 	if err != nil {
 		log.Printf("error preparing chatlog data: %v", err)
 	}
 
-	_, err = stmt.Exec(userID, userTwoID, "Testataan kannan kautta tulevia viestejä", roomID, "1513012789379")
+	_, err = stmt.Exec(userID, "Testataan kannan kautta tulevia viestejä", roomID, "1513012789379")
 	if err != nil {
 		log.Printf("error inserting chatlog data: %v", err)
 	}
 
-	stmt, err = hdb.connection.Prepare("INSERT INTO chatlog (sender, receiver, message, room_id, timestamp) VALUES ($1, $2, $3, null, $4)")
+	stmt, err = hdb.connection.Prepare("INSERT INTO chatlog (sender, receiver, message, room_id, timestamp, created_at) VALUES ($1, $2, $3, null, $4, to_timestamp($4::FLOAT8 / 1000))")
 	if err != nil {
 		log.Printf("error preparing chatlog data: %v", err)
 	}
@@ -256,7 +235,7 @@ func (hdb *HalooDB) createDefaultData() {
 		log.Printf("error inserting chatlog data: %v", err)
 	}
 
-	stmt, err = hdb.connection.Prepare("INSERT INTO chatlog (sender, receiver, message, room_id, timestamp) VALUES ($1, $2, $3, null, $4)")
+	stmt, err = hdb.connection.Prepare("INSERT INTO chatlog (sender, receiver, message, room_id, timestamp, created_at) VALUES ($1, $2, $3, null, $4, to_timestamp($4::FLOAT8 / 1000))")
 	if err != nil {
 		log.Printf("error preparing chatlog data: %v", err)
 	}
@@ -266,7 +245,7 @@ func (hdb *HalooDB) createDefaultData() {
 		log.Printf("error inserting chatlog data: %v", err)
 	}
 
-	stmt, err = hdb.connection.Prepare("INSERT INTO chatlog (sender, receiver, message, room_id, timestamp) VALUES ($1, $2, $3, null, $4)")
+	stmt, err = hdb.connection.Prepare("INSERT INTO chatlog (sender, receiver, message, room_id, timestamp, created_at) VALUES ($1, $2, $3, null, $4, to_timestamp($4::FLOAT8 / 1000))")
 	if err != nil {
 		log.Printf("error preparing chatlog data: %v", err)
 	}
@@ -276,17 +255,3 @@ func (hdb *HalooDB) createDefaultData() {
 		log.Printf("error inserting chatlog data: %v", err)
 	}
 }
-
-func (hdb *HalooDB) force() {
-	data, err := ioutil.ReadFile("./database/force.sql")
-	if err != nil {
-		log.Printf("error reading migration file: %v", err)
-	}
-
-	dataStr := string(data)
-
-	_, err = hdb.connection.Exec(dataStr)
-	if err != nil {
-		log.Printf("error executing the migration: %v", err)
-	}
-}
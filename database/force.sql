@@ -1 +0,0 @@
-DROP DATABASE haloochat;
\ No newline at end of file
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS user_conversations;
+DROP TABLE IF EXISTS room_has_users;
+DROP TABLE IF EXISTS chatlog;
+DROP TABLE IF EXISTS rooms;
+DROP TABLE IF EXISTS chat_users;
@@ -1,24 +1,22 @@
 /* Migration 25.9.2017 */
-CREATE DATABASE IF NOT EXISTS haloochat;
-
-CREATE TABLE IF NOT EXISTS chat_users 
-    (id SERIAL PRIMARY KEY, 
-    name VARCHAR(255), 
-    email VARCHAR(255), 
-    password VARCHAR(255), 
-    last_seen TIMESTAMPTZ, 
+CREATE TABLE IF NOT EXISTS chat_users
+    (id SERIAL PRIMARY KEY,
+    name VARCHAR(255),
+    email VARCHAR(255),
+    password VARCHAR(255),
+    last_seen TIMESTAMPTZ,
     profile_picture VARCHAR(255));
 
 CREATE TABLE IF NOT EXISTS rooms
     (id SERIAL PRIMARY KEY,
     name VARCHAR(255),
     picture VARCHAR(255));
-    
-CREATE TABLE IF NOT EXISTS chatlog 
-    (id SERIAL PRIMARY KEY, 
-    sender SERIAL REFERENCES chat_users (id), 
-    receiver SERIAL REFERENCES chat_users (id), 
-    message TEXT, 
+
+CREATE TABLE IF NOT EXISTS chatlog
+    (id SERIAL PRIMARY KEY,
+    sender SERIAL REFERENCES chat_users (id),
+    receiver SERIAL REFERENCES chat_users (id),
+    message TEXT,
     room_id SERIAL REFERENCES rooms (id),
     timestamp INT);
 
@@ -29,7 +27,6 @@ CREATE TABLE IF NOT EXISTS room_has_users
     INDEX (room_id, user_id));
 
 /* Migration 1.11.2017 */
-
 CREATE TABLE IF NOT EXISTS user_conversations
     (user_id SERIAL NOT NULL REFERENCES chat_users (id),
     receiver_user_id SERIAL NOT NULL REFERENCES chat_users (id),
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS chat_users@chat_users_email_key;
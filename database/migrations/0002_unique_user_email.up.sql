@@ -0,0 +1 @@
+CREATE UNIQUE INDEX IF NOT EXISTS chat_users_email_key ON chat_users (email);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS chatlog@chatlog_room_history;
+DROP INDEX IF EXISTS chatlog@chatlog_dm_history;
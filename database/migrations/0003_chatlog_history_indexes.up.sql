@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS chatlog_room_history ON chatlog (room_id, timestamp, id);
+CREATE INDEX IF NOT EXISTS chatlog_dm_history ON chatlog (sender, receiver, timestamp, id);
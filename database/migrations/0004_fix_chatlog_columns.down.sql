@@ -0,0 +1,3 @@
+/* The reference columns stay nullable INT8: rows written since the up
+   migration may hold NULLs, and the generated defaults were a bug. */
+ALTER TABLE chatlog DROP COLUMN IF EXISTS created_at;
@@ -0,0 +1,24 @@
+/* sender, receiver and room_id were declared SERIAL, so rows that left them
+   out got generated values instead of NULL. Turn them into plain nullable
+   INT8 references: room messages have no receiver and direct messages have
+   no room. The millisecond timestamp is widened to INT8 so it does not
+   overflow on PostgreSQL.
+
+   created_at is filled in by the next migration. CockroachDB does not allow
+   writing to a column in the transaction that adds it. The indexes used for
+   room and direct message history were added in 0003. */
+ALTER TABLE chatlog ALTER COLUMN sender DROP DEFAULT;
+ALTER TABLE chatlog ALTER COLUMN sender DROP NOT NULL;
+ALTER TABLE chatlog ALTER COLUMN sender TYPE INT8;
+
+ALTER TABLE chatlog ALTER COLUMN receiver DROP DEFAULT;
+ALTER TABLE chatlog ALTER COLUMN receiver DROP NOT NULL;
+ALTER TABLE chatlog ALTER COLUMN receiver TYPE INT8;
+
+ALTER TABLE chatlog ALTER COLUMN room_id DROP DEFAULT;
+ALTER TABLE chatlog ALTER COLUMN room_id DROP NOT NULL;
+ALTER TABLE chatlog ALTER COLUMN room_id TYPE INT8;
+
+ALTER TABLE chatlog ALTER COLUMN timestamp TYPE INT8;
+
+ALTER TABLE chatlog ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ;
@@ -0,0 +1,4 @@
+/* Rows that had created_at before the backfill keep it. */
+UPDATE chatlog SET created_at = NULL WHERE id IN (SELECT id FROM chatlog_created_at_backfill);
+
+DROP TABLE IF EXISTS chatlog_created_at_backfill;
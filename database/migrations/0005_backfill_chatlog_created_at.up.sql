@@ -0,0 +1,8 @@
+/* Existing rows get created_at from their millisecond timestamp. The rows
+   filled in are kept in chatlog_created_at_backfill so that the down
+   migration clears only those. */
+CREATE TABLE IF NOT EXISTS chatlog_created_at_backfill (id INT8 PRIMARY KEY);
+
+INSERT INTO chatlog_created_at_backfill (id) SELECT id FROM chatlog WHERE created_at IS NULL AND timestamp IS NOT NULL;
+
+UPDATE chatlog SET created_at = to_timestamp(timestamp::FLOAT8 / 1000) WHERE id IN (SELECT id FROM chatlog_created_at_backfill);
@@ -0,0 +1,10 @@
+/* Last chatlog ID each user has read per conversation. A room marker has
+   peer_id 0 and a direct message marker room_id 0, so that the pair can be
+   part of the primary key. */
+CREATE TABLE IF NOT EXISTS read_markers
+    (user_id INT8 NOT NULL REFERENCES chat_users (id),
+    room_id INT8 NOT NULL DEFAULT 0,
+    peer_id INT8 NOT NULL DEFAULT 0,
+    last_read_id INT8 NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, room_id, peer_id));
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS message_edits;
+ALTER TABLE chatlog DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE chatlog DROP COLUMN IF EXISTS edited_at;
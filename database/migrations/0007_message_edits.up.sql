@@ -0,0 +1,14 @@
+/* Edited and deleted messages. edited_at and deleted_at are millisecond
+   timestamps like chatlog.timestamp. A deleted message stays in the chatlog
+   as a tombstone with its text cleared. message_edits keeps the earlier
+   texts of edited messages. */
+ALTER TABLE chatlog ADD COLUMN IF NOT EXISTS edited_at INT8;
+ALTER TABLE chatlog ADD COLUMN IF NOT EXISTS deleted_at INT8;
+
+CREATE TABLE IF NOT EXISTS message_edits
+    (id SERIAL PRIMARY KEY,
+    message_id INT8 NOT NULL REFERENCES chatlog (id),
+    message TEXT,
+    edited_by INT8 REFERENCES chat_users (id),
+    edited_at INT8 NOT NULL,
+    INDEX (message_id, edited_at));
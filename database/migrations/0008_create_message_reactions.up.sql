@@ -0,0 +1,7 @@
+/* Emoji reactions, one row per message, user and emoji. */
+CREATE TABLE IF NOT EXISTS message_reactions
+    (message_id INT8 NOT NULL REFERENCES chatlog (id),
+    user_id INT8 NOT NULL REFERENCES chat_users (id),
+    emoji VARCHAR(64) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (message_id, user_id, emoji));
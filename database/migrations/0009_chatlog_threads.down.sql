@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS chatlog@chatlog_thread_history;
+ALTER TABLE chatlog DROP COLUMN IF EXISTS thread_root;
+ALTER TABLE chatlog DROP COLUMN IF EXISTS reply_to;
@@ -0,0 +1,8 @@
+/* Threaded replies. reply_to is the message replied to and thread_root the
+   first message of the thread, NULL for messages outside threads. They are
+   not foreign keys so that deleting a user does not have to delete the
+   replies of others. */
+ALTER TABLE chatlog ADD COLUMN IF NOT EXISTS reply_to INT8;
+ALTER TABLE chatlog ADD COLUMN IF NOT EXISTS thread_root INT8;
+
+CREATE INDEX IF NOT EXISTS chatlog_thread_history ON chatlog (thread_root, timestamp, id);
@@ -0,0 +1,17 @@
+/* Uploaded files. The file and the thumbnail of an image are kept in the
+   blob store under blob_key and thumbnail_key. message_id is set when the
+   file is sent in a message. created_at is a millisecond timestamp like
+   chatlog.timestamp. */
+CREATE TABLE IF NOT EXISTS attachments
+    (id SERIAL PRIMARY KEY,
+    uploader_id INT8 NOT NULL REFERENCES chat_users (id),
+    message_id INT8 REFERENCES chatlog (id),
+    name VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    size INT8 NOT NULL,
+    width INT8 NOT NULL DEFAULT 0,
+    height INT8 NOT NULL DEFAULT 0,
+    blob_key VARCHAR(64) NOT NULL,
+    thumbnail_key VARCHAR(64) NOT NULL DEFAULT '',
+    created_at INT8 NOT NULL,
+    INDEX (message_id));
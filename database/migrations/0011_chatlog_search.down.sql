@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS chatlog@chatlog_message_search;
+ALTER TABLE chatlog DROP COLUMN IF EXISTS message_tsv;
@@ -0,0 +1,6 @@
+/* Full-text search. message_tsv holds the words of a message, split and
+   lowercased by the simple configuration without stemming, and is kept up
+   to date by the database when messages are inserted, edited or deleted. */
+ALTER TABLE chatlog ADD COLUMN IF NOT EXISTS message_tsv TSVECTOR AS (to_tsvector('simple', COALESCE(message, ''))) STORED;
+
+CREATE INVERTED INDEX IF NOT EXISTS chatlog_message_search ON chatlog (message_tsv);
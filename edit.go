@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// errNotAllowed is returned when a user may not change a message.
+var errNotAllowed = errors.New("only the sender or a room admin can change the message")
+
+// MessageEdit is an earlier text of an edited message, replaced by EditedBy
+// at EditedAt.
+type MessageEdit struct {
+	Message  string `json:"message"`
+	EditedBy string `json:"edited_by"`
+	EditedAt int64  `json:"edited_at"`
+}
+
+// modifiableMessage returns a message that userID may edit or delete: their
+// own message, or any message of a room they are an admin of.
+func modifiableMessage(store Store, userID int, id int64) (Message, error) {
+	message, err := store.getMessage(id)
+	if err != nil {
+		return message, err
+	}
+
+	if message.DeletedAt != 0 {
+		return message, errMessageDeleted
+	}
+
+	if message.Sender == strconv.Itoa(userID) {
+		return message, nil
+	}
+
+	if message.RoomID != "" {
+		roomID, _ := strconv.Atoi(message.RoomID)
+		isAdmin, err := store.isRoomAdmin(roomID, userID)
+		if err != nil {
+			return message, err
+		}
+		if isAdmin {
+			return message, nil
+		}
+	}
+
+	return message, errNotAllowed
+}
+
+// applyEdit replaces the text of a message on behalf of userID and returns
+// the edited message.
+func applyEdit(store Store, userID int, id int64, text string) (Message, error) {
+	message, err := modifiableMessage(store, userID, id)
+	if err != nil {
+		return message, err
+	}
+
+	editedAt := time.Now().UnixNano() / int64(time.Millisecond)
+	if err := store.editMessage(id, text, userID, editedAt); err != nil {
+		return message, err
+	}
+
+	message.Message = text
+	message.EditedAt = editedAt
+
+	return message, nil
+}
+
+// applyDelete turns a message into a tombstone on behalf of userID and
+// returns the tombstone.
+func applyDelete(store Store, userID int, id int64) (Message, error) {
+	message, err := modifiableMessage(store, userID, id)
+	if err != nil {
+		return message, err
+	}
+
+	deletedAt := time.Now().UnixNano() / int64(time.Millisecond)
+	if err := store.deleteMessage(id, deletedAt); err != nil {
+		return message, err
+	}
+
+	message.Message = ""
+	message.DeletedAt = deletedAt
+
+	return message, nil
+}
+
+// modify edits or deletes a message on behalf of userID as asked in an edit
+// or delete frame and returns the changed message. Runs in the readPump,
+// see prepare.
+func (h *Hub) modify(userID int, envelope Envelope) (Message, *ProtocolError) {
+	var message Message
+	var err error
+	if envelope.Type == typeEdit {
+		message, err = applyEdit(h.store, userID, envelope.Message.ID, envelope.Message.Message)
+	} else {
+		message, err = applyDelete(h.store, userID, envelope.Message.ID)
+	}
+
+	switch err {
+	case nil:
+		return message, nil
+	case errNotFound:
+		return message, protocolError(errorInvalidMessage, "Message not found")
+	case errMessageDeleted:
+		return message, protocolError(errorInvalidMessage, "Message has been deleted")
+	case errNotAllowed:
+		return message, protocolError(errorForbidden, "Only the sender or a room admin can change the message")
+	default:
+		log.Printf("error changing message: %v", err)
+		return message, protocolError(errorInternal, "Message could not be changed")
+	}
+}
+
+// handleModify acknowledges an edit or delete and sends the update to
+// everyone who received the message.
+func (h *Hub) handleModify(client *Client, in inbound) {
+	h.ack(client, in.envelope, Envelope{ID: in.message.ID})
+	h.announce(in)
+}
+
+// writeModifyError writes the response for an error from applyEdit or
+// applyDelete.
+func writeModifyError(w http.ResponseWriter, err error) {
+	switch err {
+	case errNotFound:
+		writeJSONError(w, 404, "Message not found")
+	case errMessageDeleted:
+		writeJSONError(w, 409, "Message has been deleted")
+	case errNotAllowed:
+		writeJSONError(w, 403, "Only the sender or a room admin can change the message")
+	default:
+		log.Printf("error changing message: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+	}
+}
+
+func messageIDFromPath(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, 400, "Invalid message id")
+		return 0, false
+	}
+
+	return id, true
+}
+
+// serveEditMessage changes the text of a message with {"message": "..."}.
+func serveEditMessage(hub *Hub, store Store, w http.ResponseWriter, r *http.Request, userID int) {
+	log.Println(r.URL)
+
+	id, ok := messageIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var body Message
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	if problem := validateText(body.Message); problem != nil {
+		writeJSONError(w, 400, problem.Message)
+		return
+	}
+
+	message, err := applyEdit(store, userID, id, body.Message)
+	if err != nil {
+		writeModifyError(w, err)
+		return
+	}
+
+	hub.updates <- message
+
+	writeJSON(w, 200, message)
+}
+
+// serveDeleteMessage deletes a message, leaving a tombstone in its place.
+func serveDeleteMessage(hub *Hub, store Store, w http.ResponseWriter, r *http.Request, userID int) {
+	log.Println(r.URL)
+
+	id, ok := messageIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	message, err := applyDelete(store, userID, id)
+	if err != nil {
+		writeModifyError(w, err)
+		return
+	}
+
+	hub.updates <- message
+
+	writeJSON(w, 200, message)
+}
+
+// serveMessageEdits returns the earlier texts of a message, oldest first.
+// Everyone who can read the message can read its edits. A deleted message
+// has none.
+func serveMessageEdits(store Store, w http.ResponseWriter, r *http.Request, userID int) {
+	log.Println(r.URL)
+
+	id, ok := messageIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	message, err := store.getMessage(id)
+	if err != nil {
+		if err != errNotFound {
+			log.Printf("error getting message: %v", err)
+			writeJSONError(w, 500, "Internal server error")
+			return
+		}
+
+		writeJSONError(w, 404, "Message not found")
+		return
+	}
+
+	visible, err := canReadMessage(store, userID, message)
+	if err != nil {
+		log.Printf("error checking room membership: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	if !visible {
+		writeJSONError(w, 403, "Not a participant of the conversation")
+		return
+	}
+
+	edits, err := store.messageEdits(id)
+	if err != nil {
+		log.Printf("error getting message edits: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	if edits == nil {
+		edits = []MessageEdit{}
+	}
+
+	writeJSON(w, 200, map[string][]MessageEdit{"edits": edits})
+}
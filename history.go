@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// messageCursor is a position in a history. Messages are ordered by
+// timestamp and messages sharing a timestamp by ID.
+type messageCursor struct {
+	timestamp int64
+	id        int64
+}
+
+// historyPage selects messages older than before or newer than after. If
+// neither is set, the newest messages are selected.
+type historyPage struct {
+	before *messageCursor
+	after  *messageCursor
+	limit  int
+}
+
+func cursorOf(message Message) messageCursor {
+	return messageCursor{timestamp: message.Timestamp, id: message.ID}
+}
+
+// less reports whether c comes before other in a history.
+func (c messageCursor) less(other messageCursor) bool {
+	if c.timestamp != other.timestamp {
+		return c.timestamp < other.timestamp
+	}
+
+	return c.id < other.id
+}
+
+// encode returns the opaque form of the cursor handed to clients.
+func (c messageCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.timestamp, c.id)))
+}
+
+func decodeCursor(encoded string) (*messageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	var c messageCursor
+	if _, err := fmt.Sscanf(string(data), "%d:%d", &c.timestamp, &c.id); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// paginate selects a page from messages sorted oldest first. The page is
+// returned oldest first as well.
+func paginate(messages []Message, page historyPage) []Message {
+	var selected []Message
+	for _, message := range messages {
+		c := cursorOf(message)
+		if page.before != nil && !c.less(*page.before) {
+			continue
+		}
+		if page.after != nil && !page.after.less(c) {
+			continue
+		}
+
+		selected = append(selected, message)
+	}
+
+	if len(selected) <= page.limit {
+		return selected
+	}
+
+	if page.after != nil {
+		return selected[:page.limit]
+	}
+
+	return selected[len(selected)-page.limit:]
+}
+
+// parseHistoryPage reads the before, after and limit query parameters.
+func parseHistoryPage(r *http.Request) (historyPage, string) {
+	page := historyPage{limit: config.Limits.HistoryLimit}
+	query := r.URL.Query()
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return page, "Invalid limit"
+		}
+
+		if limit > config.Limits.MaxHistoryLimit {
+			limit = config.Limits.MaxHistoryLimit
+		}
+		page.limit = limit
+	}
+
+	if value := query.Get("before"); value != "" {
+		c, err := decodeCursor(value)
+		if err != nil {
+			return page, "Invalid before cursor"
+		}
+		page.before = c
+	}
+
+	if value := query.Get("after"); value != "" {
+		c, err := decodeCursor(value)
+		if err != nil {
+			return page, "Invalid after cursor"
+		}
+		page.after = c
+	}
+
+	if page.before != nil && page.after != nil {
+		return page, "Only one of before and after can be given"
+	}
+
+	return page, ""
+}
+
+// HistoryResponse is one page of history.
+type HistoryResponse struct {
+	Messages   []Message `json:"messages"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// serveHistory writes one page of history, with the replies of the thread
+// roots in it summarized and the attachments filled in.
+func serveHistory(store Store, w http.ResponseWriter, r *http.Request, fetch func(page historyPage) ([]Message, error)) {
+	response, ok := loadHistory(w, r, fetch)
+	if !ok {
+		return
+	}
+
+	if err := attachThreads(store, response.Messages); err != nil {
+		log.Printf("error reading thread summaries: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	if err := attachAttachments(store, response.Messages); err != nil {
+		log.Printf("error reading attachments: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	writeJSON(w, 200, response)
+}
+
+// loadHistory reads the page of history asked for in the request, writing
+// an error response and returning false if that fails. fetch is asked for
+// one message more than the limit to find out whether there is a next page.
+func loadHistory(w http.ResponseWriter, r *http.Request, fetch func(page historyPage) ([]Message, error)) (HistoryResponse, bool) {
+	page, problem := parseHistoryPage(r)
+	if problem != "" {
+		writeJSONError(w, 400, problem)
+		return HistoryResponse{}, false
+	}
+
+	limit := page.limit
+	page.limit++
+
+	messages, err := fetch(page)
+	if err != nil {
+		log.Printf("error reading history: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return HistoryResponse{}, false
+	}
+
+	response := HistoryResponse{Messages: messages}
+	if response.Messages == nil {
+		response.Messages = []Message{}
+	}
+
+	// The extra message is on the side the client is paging towards: newer
+	// messages when paging with after, older ones otherwise.
+	if len(messages) > limit {
+		if page.after != nil {
+			response.Messages = messages[:limit]
+			response.NextCursor = cursorOf(response.Messages[limit-1]).encode()
+		} else {
+			response.Messages = messages[1:]
+			response.NextCursor = cursorOf(response.Messages[0]).encode()
+		}
+	}
+
+	return response, true
+}
+
+// serveRoomHistory returns a page of the history of a room. Only members of
+// the room may read it.
+func serveRoomHistory(store Store, w http.ResponseWriter, r *http.Request, userID int) {
+	log.Println(r.URL)
+
+	room, ok := roomFromPath(store, w, r)
+	if !ok {
+		return
+	}
+
+	member, err := isRoomMember(store, room.ID, userID)
+	if err != nil {
+		log.Printf("error checking room membership: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	if !member {
+		writeJSONError(w, 403, "Not a member of the room")
+		return
+	}
+
+	serveHistory(store, w, r, func(page historyPage) ([]Message, error) {
+		return store.roomHistory(room.ID, page)
+	})
+}
+
+// serveDirectHistory returns a page of the direct messages between the
+// authenticated user and the peer given in the path.
+func serveDirectHistory(store Store, w http.ResponseWriter, r *http.Request, userID int) {
+	log.Println(r.URL)
+
+	peerID, err := strconv.Atoi(r.PathValue("peer"))
+	if err != nil {
+		writeJSONError(w, 400, "Invalid peer id")
+		return
+	}
+
+	if _, err := store.getUser(peerID); err != nil {
+		if err != errNotFound {
+			log.Printf("error getting user: %v", err)
+			writeJSONError(w, 500, "Internal server error")
+			return
+		}
+
+		writeJSONError(w, 404, "User not found")
+		return
+	}
+
+	serveHistory(store, w, r, func(page historyPage) ([]Message, error) {
+		return store.directHistory(userID, peerID, page)
+	})
+}
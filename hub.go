@@ -4,14 +4,52 @@
 
 package main
 
-// Hub maintains the set of active clients and broadcasts messages to the
-// clients.
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Hub maintains the set of active clients, tracks which rooms each of them
+// is subscribed to and routes messages to the clients they are addressed to.
 type Hub struct {
 	// Registered clients.
 	clients map[*Client]bool
 
-	// Inbound messages from the clients.
-	broadcast chan []byte
+	// Registered clients indexed by user ID. One user can be connected from
+	// several devices at once.
+	users map[int]map[*Client]bool
+
+	// Subscribed clients indexed by room ID. A room is added on its first
+	// subscription and removed when its last subscriber leaves.
+	rooms map[int]map[*Client]bool
+
+	// Cached room memberships, shared with the readPumps.
+	members *memberCache
+
+	// Last announced status of the connected users, online or away.
+	statuses map[int]string
+
+	// Contacts of connected users, who are sent their presence changes.
+	contacts map[int]map[int]bool
+
+	// Presence changes waiting for the contacts of their user to load.
+	pendingPresence map[int]Presence
+
+	// Incremented when room memberships change so that contacts loaded
+	// before are not cached.
+	contactsVersion int
+
+	// Users typing and when their typing expires.
+	typing map[typingKey]time.Time
+
+	// Inbound envelopes from the clients.
+	inbound chan inbound
 
 	// Register requests from the clients.
 	register chan *Client
@@ -19,39 +57,640 @@ type Hub struct {
 	// Unregister requests from clients.
 	unregister chan *Client
 
-	// Database connection.
-	dbconn *HalooDB
+	// Rooms whose cached memberships have changed.
+	invalidate chan int
+
+	// Deleted users, whose clients are closed.
+	deletedUsers chan int
+
+	// Room members loaded for checking the subscribers of a room.
+	membersLoaded chan loadedMembers
+
+	// Contacts loaded for announcing the presence of a user.
+	contactsLoaded chan loadedContacts
+
+	// Resuming clients to subscribe to the rooms of their resume frame.
+	resumeSubscriptions chan resumeSubscription
+
+	// Resuming clients whose resume frame did not arrive in time.
+	resumeExpired chan *Client
+
+	// Results of messages written to the chatlog.
+	persisted chan persistResult
+
+	// Presence snapshot requests from the REST API.
+	presenceQueries chan presenceQuery
+
+	// Read markers saved through the REST API, to be announced.
+	receipts chan readReceipt
+
+	// Messages edited or deleted through the REST API, to be announced.
+	updates chan Message
+
+	// Users, rooms and memberships.
+	store Store
+
+	// Writes messages to the chatlog.
+	persister *Persister
+
+	// Shutdown requests. The channel sent is closed once every client has
+	// been closed.
+	shutdown chan chan bool
+
+	// Set when shutting down. New messages are rejected and new clients
+	// closed right away.
+	draining bool
+
+	// The persister's stopped channel while draining, closed when the queued
+	// messages have been saved.
+	flushed <-chan bool
+
+	// Closed when the clients have been closed after a shutdown request.
+	drained chan bool
+
+	// Running writePumps, waited for so that the frames left in the send
+	// buffers reach the clients before exiting.
+	writers sync.WaitGroup
+
+	// Running last_seen writes, waited for before exiting.
+	lastSeenWrites sync.WaitGroup
 }
 
-func newHub(dbconnection *HalooDB) *Hub {
+func newHub(store Store, persister *Persister) *Hub {
 	return &Hub{
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
-		dbconn:     dbconnection,
+		inbound:             make(chan inbound),
+		register:            make(chan *Client),
+		unregister:          make(chan *Client),
+		invalidate:          make(chan int),
+		deletedUsers:        make(chan int),
+		membersLoaded:       make(chan loadedMembers),
+		contactsLoaded:      make(chan loadedContacts),
+		resumeSubscriptions: make(chan resumeSubscription),
+		resumeExpired:       make(chan *Client),
+		persisted:           make(chan persistResult),
+		presenceQueries:     make(chan presenceQuery),
+		receipts:            make(chan readReceipt),
+		updates:             make(chan Message),
+		shutdown:            make(chan chan bool),
+		clients:             make(map[*Client]bool),
+		users:               make(map[int]map[*Client]bool),
+		rooms:               make(map[int]map[*Client]bool),
+		members:             newMemberCache(store),
+		statuses:            make(map[int]string),
+		contacts:            make(map[int]map[int]bool),
+		pendingPresence:     make(map[int]Presence),
+		typing:              make(map[typingKey]time.Time),
+		store:               store,
+		persister:           persister,
 	}
 }
 
 func (h *Hub) run() {
+	ticker := time.NewTicker(presenceCheckPeriod)
+	defer ticker.Stop()
+
+	typingTicker := time.NewTicker(typingCheckPeriod)
+	defer typingTicker.Stop()
+
 	for {
 		select {
 		case client := <-h.register:
-			h.clients[client] = true
+			h.addClient(client)
 		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
-			}
-		case message := <-h.broadcast:
-			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
+			h.removeClient(client)
+		case in := <-h.inbound:
+			h.handle(in)
+		case result := <-h.persisted:
+			h.complete(result)
+		case roomID := <-h.invalidate:
+			h.reloadMembers(roomID)
+		case userID := <-h.deletedUsers:
+			h.disconnectUser(userID)
+		case loaded := <-h.membersLoaded:
+			h.checkSubscribers(loaded)
+		case loaded := <-h.contactsLoaded:
+			h.contactsReady(loaded)
+		case subscription := <-h.resumeSubscriptions:
+			h.subscribeResuming(subscription)
+		case client := <-h.resumeExpired:
+			h.expireResume(client)
+		case receipt := <-h.receipts:
+			h.broadcastReceipt(receipt)
+		case message := <-h.updates:
+			h.route(typeUpdate, message)
+		case query := <-h.presenceQueries:
+			query.reply <- h.snapshot(query.userIDs)
+		case <-ticker.C:
+			h.checkIdle()
+		case <-typingTicker.C:
+			h.expireTyping()
+		case drained := <-h.shutdown:
+			h.startDraining(drained)
+		case <-h.flushed:
+			h.closeAll()
+		}
+	}
+}
+
+// drain stops the hub from taking new messages, waits until the queued ones
+// have been saved and acked, and closes every client with a going away
+// frame. It returns once the clients have been written everything left in
+// their send buffers and their last_seen saved, or when ctx is done.
+func (h *Hub) drain(ctx context.Context) error {
+	drained := make(chan bool)
+	select {
+	case h.shutdown <- drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	flushed := make(chan bool)
+	go func() {
+		h.writers.Wait()
+		h.lastSeenWrites.Wait()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *Hub) startDraining(drained chan bool) {
+	if h.draining {
+		return
+	}
+
+	h.draining = true
+	h.drained = drained
+	h.flushed = h.persister.stopped
+
+	// The hub is the only one enqueueing, so nothing is sent to the closed
+	// queue.
+	h.persister.close()
+}
+
+// closeAll tells every client to go away and closes them.
+func (h *Hub) closeAll() {
+	h.flushed = nil
+
+	for client := range h.clients {
+		h.goAway(client)
+	}
+
+	close(h.drained)
+}
+
+// goAway sends a going away frame with a reconnect hint to a client and
+// closes it.
+func (h *Hub) goAway(client *Client) {
+	client.closeMessage = websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server is shutting down")
+	h.send(client, Envelope{Type: typeGoingAway, ReconnectAfter: config.Shutdown.ReconnectAfterSeconds})
+	h.removeClient(client)
+}
+
+// disconnectUser closes the clients of a deleted user.
+func (h *Hub) disconnectUser(userID int) {
+	for client := range h.users[userID] {
+		client.closeMessage = websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Account deleted")
+		h.removeClient(client)
+	}
+}
+
+func (h *Hub) addClient(client *Client) {
+	h.clients[client] = true
+	client.lastActive = time.Now()
+
+	devices, ok := h.users[client.userID]
+	if !ok {
+		devices = make(map[*Client]bool)
+		h.users[client.userID] = devices
+	}
+	devices[client] = true
+
+	// A client that connected just before the listener was closed is told to
+	// come back later.
+	if h.draining {
+		h.goAway(client)
+		return
+	}
+
+	if client.resuming {
+		h.startResumeTimer(client)
+	}
+
+	h.updatePresence(client.userID)
+}
+
+func (h *Hub) removeClient(client *Client) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+
+	for roomID := range client.rooms {
+		h.unsubscribe(client, roomID)
+	}
+
+	delete(h.clients, client)
+	close(client.send)
+	close(client.gone)
+
+	if devices, ok := h.users[client.userID]; ok {
+		delete(devices, client)
+		if len(devices) == 0 {
+			delete(h.users, client.userID)
+			h.stopAllTyping(client.userID)
+		}
+	}
+
+	h.updatePresence(client.userID)
+}
+
+// prepare validates an envelope received from a client and does the store
+// work it needs: membership checks, lookups and writes. It runs in the
+// client's readPump so that a slow store holds up only that client, and the
+// hub acts on the result without going to the store itself.
+func (h *Hub) prepare(client *Client, envelope Envelope) inbound {
+	in := inbound{client: client, envelope: envelope}
+
+	if in.problem = validateEnvelope(envelope); in.problem != nil {
+		return in
+	}
+
+	switch envelope.Type {
+	case typeSubscribe:
+		roomID, _ := strconv.Atoi(envelope.RoomID)
+		in.problem = h.requireMember(roomID, client.userID)
+	case typeTypingStart, typeTypingStop:
+		if envelope.Typing.RoomID != "" {
+			roomID, _ := strconv.Atoi(envelope.Typing.RoomID)
+			in.problem = h.requireMember(roomID, client.userID)
+		} else {
+			receiverID, _ := strconv.Atoi(envelope.Typing.Receiver)
+			in.problem = h.requireConversation(client.userID, receiverID)
+		}
+	case typeMarkRead:
+		in.receipt, in.problem = h.saveReadMarker(client.userID, *envelope.Read)
+	case typeEdit, typeDelete:
+		in.message, in.problem = h.modify(client.userID, envelope)
+	case typeReactionAdd, typeReactionRemove:
+		in.message, in.changed, in.problem = h.react(client.userID, *envelope.Reaction, envelope.Type)
+	case typeResume:
+		in.resume, in.problem = h.prepareResume(client, *envelope.Resume)
+	case typeMessage:
+		in.message = Message{Sender: envelope.Message.Sender, Receiver: envelope.Message.Receiver, Message: envelope.Message.Message, RoomID: envelope.Message.RoomID, ReplyTo: envelope.Message.ReplyTo, Attachments: envelope.Message.Attachments}
+		in.threadRecipients, in.problem = h.prepareMessage(&in.message)
+	}
+
+	return in
+}
+
+// handle processes one envelope received from a client once prepare has
+// validated it. Messages are only delivered once they have been written to
+// the chatlog.
+func (h *Hub) handle(in inbound) {
+	client, envelope := in.client, in.envelope
+	if _, ok := h.clients[client]; !ok {
+		// What prepare has stored is announced even though the client is
+		// gone, only the ack is left out.
+		if in.problem == nil {
+			h.announce(in)
+		}
+		return
+	}
+
+	if in.problem != nil {
+		if envelope.Type == typeResume {
+			h.unsubscribeResume(client)
+		}
+		h.reject(client, envelope, in.problem)
+		return
+	}
+
+	if envelope.Type != typePresence {
+		h.markActive(client)
+	}
+
+	switch envelope.Type {
+	case typeSubscribe:
+		h.handleSubscribe(client, envelope)
+	case typeUnsubscribe:
+		roomID, _ := strconv.Atoi(envelope.RoomID)
+		h.unsubscribe(client, roomID)
+		h.ack(client, envelope, Envelope{RoomID: envelope.RoomID})
+	case typePresence:
+		client.away = envelope.Presence.Status == statusAway
+		client.lastActive = time.Now()
+		h.updatePresence(client.userID)
+		h.ack(client, envelope, Envelope{})
+	case typeTypingStart, typeTypingStop:
+		h.handleTyping(client, envelope)
+	case typeMarkRead:
+		h.handleMarkRead(client, in)
+	case typeEdit, typeDelete:
+		h.handleModify(client, in)
+	case typeReactionAdd, typeReactionRemove:
+		h.handleReaction(client, in)
+	case typeResume:
+		h.handleResume(client, in)
+	case typeMessage:
+		if h.draining {
+			h.reject(client, envelope, protocolError(errorBusy, "Server is shutting down, try again later"))
+			return
+		}
+
+		message := in.message
+		message.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+
+		request := persistRequest{message: message, client: client, clientMsgID: envelope.ClientMsgID, threadRecipients: in.threadRecipients, done: h.persisted}
+		if !h.persister.enqueue(request) {
+			h.reject(client, envelope, protocolError(errorBusy, "Server is busy, try again later"))
+		}
+	}
+}
+
+// announce tells the participants of a conversation about a change prepare
+// has stored: a read marker, an edit or a deletion, or a reaction.
+func (h *Hub) announce(in inbound) {
+	switch in.envelope.Type {
+	case typeMarkRead:
+		h.broadcastReceipt(in.receipt)
+	case typeEdit, typeDelete:
+		h.route(typeUpdate, in.message)
+	case typeReactionAdd, typeReactionRemove:
+		if in.changed {
+			reaction := *in.envelope.Reaction
+			reaction.UserID = strconv.Itoa(in.client.userID)
+			h.broadcast(in.message, Envelope{Type: in.envelope.Type, Reaction: &reaction})
+		}
+	}
+}
+
+// complete acknowledges a persisted message to its sender and delivers it to
+// its recipients.
+func (h *Hub) complete(result persistResult) {
+	request := result.request
+	envelope := Envelope{Type: typeMessage, ClientMsgID: request.clientMsgID}
+
+	if result.err == errAttachmentTaken {
+		h.reject(request.client, envelope, protocolError(errorInvalidMessage, "Attachment has already been sent"))
+		return
+	}
+	if result.err != nil {
+		h.reject(request.client, envelope, protocolError(errorInternal, "Message could not be saved"))
+		return
+	}
+
+	for i := range request.message.Attachments {
+		request.message.Attachments[i].MessageID = request.message.ID
+	}
+
+	h.stopTyping(typingKeyOf(request.message))
+	h.addContacts(request.message)
+	h.route(typeMessage, request.message)
+	h.notifyThread(request.message, request.threadRecipients)
+	h.ack(request.client, envelope, Envelope{ID: request.message.ID, Timestamp: request.message.Timestamp})
+}
+
+// handleSubscribe subscribes a client to a room whose membership prepare
+// has checked.
+func (h *Hub) handleSubscribe(client *Client, envelope Envelope) {
+	roomID, _ := strconv.Atoi(envelope.RoomID)
+
+	// The members may have changed since prepare looked at them.
+	members, cached := h.members.cached(roomID)
+	if cached && !members[client.userID] {
+		h.reject(client, envelope, protocolError(errorForbidden, "Not a member of the room"))
+		return
+	}
+
+	h.subscribe(client, roomID)
+	h.ack(client, envelope, Envelope{RoomID: envelope.RoomID})
+
+	if !cached {
+		h.loadMembers(roomID)
+	}
+}
+
+func (h *Hub) subscribe(client *Client, roomID int) {
+	subscribers, ok := h.rooms[roomID]
+	if !ok {
+		subscribers = make(map[*Client]bool)
+		h.rooms[roomID] = subscribers
+	}
+	subscribers[client] = true
+	client.rooms[roomID] = true
+}
+
+func (h *Hub) unsubscribe(client *Client, roomID int) {
+	delete(client.rooms, roomID)
+
+	if subscribers, ok := h.rooms[roomID]; ok {
+		delete(subscribers, client)
+		if len(subscribers) == 0 {
+			delete(h.rooms, roomID)
+		}
+	}
+}
+
+// prepareMessage checks that the sender of a new message may send it and
+// resolves its thread and attachments. It returns the users to tell about a
+// reply to a room thread. Runs in the readPump, see prepare.
+func (h *Hub) prepareMessage(message *Message) ([]int, *ProtocolError) {
+	if message.RoomID != "" {
+		senderID, _ := strconv.Atoi(message.Sender)
+		roomID, _ := strconv.Atoi(message.RoomID)
+		if problem := h.requireMember(roomID, senderID); problem != nil {
+			return nil, problem
+		}
+	}
+
+	if problem := h.resolveThread(message); problem != nil {
+		return nil, problem
+	}
+
+	if problem := h.resolveAttachments(message); problem != nil {
+		return nil, problem
+	}
+
+	return h.threadRecipients(*message), nil
+}
+
+// requireMember checks that a user is a member of a room. Runs in the
+// readPump, see prepare.
+func (h *Hub) requireMember(roomID int, userID int) *ProtocolError {
+	member, err := h.members.isMember(roomID, userID)
+	if err != nil {
+		log.Printf("error getting room members: %v", err)
+		return protocolError(errorInternal, "Room members could not be read")
+	}
+
+	if !member {
+		return protocolError(errorForbidden, "Not a member of the room")
+	}
+
+	return nil
+}
+
+// route delivers a message or an update of it to the clients it is
+// addressed to.
+func (h *Hub) route(frameType string, message Message) {
+	h.broadcast(message, Envelope{Type: frameType, Message: &message})
+}
+
+// broadcast sends an envelope to everyone who receives the given message.
+// Direct messages go to every device of the sender and the receiver, room
+// messages go to every client subscribed to the room.
+func (h *Hub) broadcast(message Message, envelope Envelope) {
+	data := h.encode(envelope)
+	if data == nil {
+		return
+	}
+
+	if message.RoomID == "" {
+		senderID, _ := strconv.Atoi(message.Sender)
+		receiverID, _ := strconv.Atoi(message.Receiver)
+
+		for client := range h.users[senderID] {
+			h.deliverRouted(client, envelope.Type, message, data)
+		}
+		if receiverID != senderID {
+			for client := range h.users[receiverID] {
+				h.deliverRouted(client, envelope.Type, message, data)
 			}
 		}
+		return
+	}
+
+	roomID, _ := strconv.Atoi(message.RoomID)
+	for client := range h.rooms[roomID] {
+		h.deliverRouted(client, envelope.Type, message, data)
+	}
+}
+
+// loadedMembers is the result of loading the members of a room outside the
+// hub.
+type loadedMembers struct {
+	roomID  int
+	members map[int]bool
+	err     error
+}
+
+// reloadMembers drops the cached members of a room and the cached contacts
+// after they have changed, and checks the subscribers of the room against the
+// new members.
+func (h *Hub) reloadMembers(roomID int) {
+	h.members.invalidate(roomID)
+	h.dropContacts()
+
+	if _, ok := h.rooms[roomID]; ok {
+		h.loadMembers(roomID)
+	}
+}
+
+// loadMembers loads the members of a room outside the hub and hands them to
+// checkSubscribers.
+func (h *Hub) loadMembers(roomID int) {
+	go func() {
+		members, err := h.members.get(roomID)
+		h.membersLoaded <- loadedMembers{roomID: roomID, members: members, err: err}
+	}()
+}
+
+// checkSubscribers unsubscribes the clients of users who are no longer
+// members of a room. If the members could not be loaded, it tries again
+// later.
+func (h *Hub) checkSubscribers(loaded loadedMembers) {
+	if _, ok := h.rooms[loaded.roomID]; !ok {
+		return
+	}
+
+	if loaded.err != nil {
+		log.Printf("error getting room members: %v", loaded.err)
+		time.AfterFunc(membersRetryDelay, func() { h.loadMembers(loaded.roomID) })
+		return
+	}
+
+	for client := range h.rooms[loaded.roomID] {
+		if !loaded.members[client.userID] {
+			h.unsubscribe(client, loaded.roomID)
+			h.send(client, Envelope{Type: typeUnsubscribe, RoomID: strconv.Itoa(loaded.roomID)})
+		}
+	}
+}
+
+// ack confirms a request to the client that sent it.
+func (h *Hub) ack(client *Client, request Envelope, ack Envelope) {
+	h.release(client, request)
+
+	ack.Type = typeAck
+	ack.Ref = request.Type
+	ack.ClientMsgID = request.ClientMsgID
+	h.send(client, ack)
+}
+
+// reject sends an error frame for a request to the client that sent it.
+func (h *Hub) reject(client *Client, request Envelope, problem *ProtocolError) {
+	h.release(client, request)
+
+	h.send(client, Envelope{Type: typeError, Ref: request.Type, ClientMsgID: request.ClientMsgID, Error: problem})
+}
+
+// release frees the in-flight slot a message request held, letting the
+// client's readPump continue.
+func (h *Hub) release(client *Client, request Envelope) {
+	if request.Type != typeMessage {
+		return
+	}
+
+	select {
+	case <-client.inflight:
+	default:
+	}
+}
+
+func (h *Hub) send(client *Client, envelope Envelope) {
+	if data := h.encode(envelope); data != nil {
+		h.deliver(client, data)
+	}
+}
+
+func (h *Hub) encode(envelope Envelope) []byte {
+	envelope.V = protocolVersion
+
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		log.Printf("error converting envelope to JSON: %v", err)
+		return nil
+	}
+
+	return data
+}
+
+func (h *Hub) sendToUser(userID int, data []byte) {
+	for client := range h.users[userID] {
+		h.deliver(client, data)
+	}
+}
+
+func (h *Hub) deliver(client *Client, data []byte) {
+	// The client may have been dropped while routing this same message.
+	if !h.clients[client] {
+		return
+	}
+
+	select {
+	case client.send <- data:
+	default:
+		h.removeClient(client)
 	}
 }
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestHub runs a hub with a persister on a memory store holding a
+// storeFixture.
+func newTestHub(t *testing.T) (*Hub, storeFixture) {
+	return newTestHubOn(t, newMemoryStore())
+}
+
+// newTestHubOn runs a hub with a persister on the given store after adding
+// a storeFixture to it.
+func newTestHubOn(t *testing.T, store Store) (*Hub, storeFixture) {
+	f := newStoreFixture(t, store)
+
+	persister := newPersister(store)
+	go persister.run()
+
+	hub := newHub(store, persister)
+	go hub.run()
+
+	return hub, f
+}
+
+// connect registers a client of a user the way serveWs does, without a
+// websocket. The frames for it are read from its send channel.
+func connect(hub *Hub, user User, resume bool) *Client {
+	client := &Client{hub: hub, send: make(chan []byte, config.Limits.SendBufferSize), userID: user.ID, rooms: make(map[int]bool), inflight: make(chan bool, config.Limits.MaxInFlight), gone: make(chan bool)}
+	if resume {
+		client.resuming = true
+		client.dropped = make(map[conversation]bool)
+	}
+	hub.register <- client
+
+	return client
+}
+
+// submit hands a frame from a client to the hub the way the readPump does.
+func submit(client *Client, envelope Envelope) {
+	envelope.V = protocolVersion
+	if envelope.Message != nil {
+		envelope.Message.Sender = strconv.Itoa(client.userID)
+	}
+
+	if envelope.Type == typeMessage {
+		client.inflight <- true
+	}
+
+	client.hub.inbound <- client.hub.prepare(client, envelope)
+}
+
+// next returns the next frame sent to a client, skipping presence frames
+// which arrive whenever users come and go.
+func next(t *testing.T, client *Client) Envelope {
+	t.Helper()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case data, ok := <-client.send:
+			if !ok {
+				t.Fatal("client was closed")
+			}
+
+			var envelope Envelope
+			if err := json.Unmarshal(data, &envelope); err != nil {
+				t.Fatal(err)
+			}
+			if envelope.Type != typePresence {
+				return envelope
+			}
+		case <-timeout:
+			t.Fatal("no frame sent to the client")
+		}
+	}
+}
+
+// expect returns the next frame sent to a client and checks its type.
+func expect(t *testing.T, client *Client, frameType string) Envelope {
+	t.Helper()
+
+	envelope := next(t, client)
+	if envelope.Type != frameType {
+		t.Fatalf("got a %s frame %+v, want %s", envelope.Type, envelope, frameType)
+	}
+
+	return envelope
+}
+
+// expectNothing checks that a client is sent nothing but presence frames for
+// a while.
+func expectNothing(t *testing.T, client *Client) {
+	t.Helper()
+
+	timeout := time.After(100 * time.Millisecond)
+	for {
+		select {
+		case data := <-client.send:
+			var envelope Envelope
+			json.Unmarshal(data, &envelope)
+			if envelope.Type != typePresence {
+				t.Fatalf("unexpected %s frame %s", envelope.Type, data)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// subscribe subscribes clients to the room of the fixture.
+func subscribe(t *testing.T, f storeFixture, clients ...*Client) {
+	t.Helper()
+
+	for _, client := range clients {
+		submit(client, Envelope{Type: typeSubscribe, RoomID: strconv.Itoa(f.room.ID)})
+		expect(t, client, typeAck)
+	}
+}
+
+// send sends a message from a client and returns its ack. The sender gets
+// the message before the ack.
+func send(t *testing.T, client *Client, message Message) Envelope {
+	t.Helper()
+
+	submit(client, Envelope{Type: typeMessage, ClientMsgID: "m", Message: &message})
+	expect(t, client, typeMessage)
+
+	return expect(t, client, typeAck)
+}
+
+func TestHubAcksAndRoutesMessages(t *testing.T) {
+	hub, f := newTestHub(t)
+
+	alice := connect(hub, f.alice, false)
+	bob := connect(hub, f.bob, false)
+	bobPhone := connect(hub, f.bob, false)
+	carol := connect(hub, f.carol, false)
+	subscribe(t, f, alice, bob)
+
+	tests := []struct {
+		name       string
+		sender     *Client
+		message    Message
+		recipients []*Client
+		others     []*Client
+	}{
+		{"room message", alice, Message{RoomID: strconv.Itoa(f.room.ID), Message: "hello room"}, []*Client{alice, bob}, []*Client{bobPhone, carol}},
+		{"direct message", alice, Message{Receiver: strconv.Itoa(f.bob.ID), Message: "hello bob"}, []*Client{alice, bob, bobPhone}, []*Client{carol}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			submit(test.sender, Envelope{Type: typeMessage, ClientMsgID: test.name, Message: &test.message})
+
+			for _, client := range test.recipients {
+				message := expect(t, client, typeMessage)
+				if message.Message.Message != test.message.Message || message.Message.Sender != strconv.Itoa(f.alice.ID) {
+					t.Errorf("delivered %+v", message.Message)
+				}
+
+				if client == test.sender {
+					ack := expect(t, client, typeAck)
+					if ack.Ref != typeMessage || ack.ClientMsgID != test.name || ack.ID != message.Message.ID || ack.Timestamp == 0 {
+						t.Errorf("ack = %+v", ack)
+					}
+				}
+			}
+
+			for _, client := range test.others {
+				expectNothing(t, client)
+			}
+		})
+	}
+}
+
+func TestHubRejectsMessagesOfNonMembers(t *testing.T) {
+	hub, f := newTestHub(t)
+
+	carol := connect(hub, f.carol, false)
+	submit(carol, Envelope{Type: typeMessage, ClientMsgID: "x", Message: &Message{RoomID: strconv.Itoa(f.room.ID), Message: "let me in"}})
+
+	reply := expect(t, carol, typeError)
+	if reply.Ref != typeMessage || reply.ClientMsgID != "x" || reply.Error.Code != errorForbidden {
+		t.Errorf("error = %+v", reply)
+	}
+
+	// The in-flight slot was given back.
+	if len(carol.inflight) != 0 {
+		t.Errorf("%d messages still in flight", len(carol.inflight))
+	}
+}
+
+// A room ID looked up before the room exists is not remembered as a room
+// without members.
+func TestHubSubscribeToNewRoom(t *testing.T) {
+	hub, f := newTestHub(t)
+
+	carol := connect(hub, f.carol, false)
+	roomID := strconv.Itoa(f.room.ID + 1)
+
+	submit(carol, Envelope{Type: typeSubscribe, RoomID: roomID})
+	if reply := expect(t, carol, typeError); reply.Error.Code != errorForbidden {
+		t.Errorf("error = %+v, want forbidden", reply.Error)
+	}
+
+	room := Room{Name: "New"}
+	if err := hub.store.createRoom(&room, f.carol.ID); err != nil {
+		t.Fatal(err)
+	}
+	if strconv.Itoa(room.ID) != roomID {
+		t.Fatalf("room ID = %d, want %s", room.ID, roomID)
+	}
+
+	submit(carol, Envelope{Type: typeSubscribe, RoomID: roomID})
+	expect(t, carol, typeAck)
+}
+
+func TestHubEditFanOut(t *testing.T) {
+	hub, f := newTestHub(t)
+
+	alice := connect(hub, f.alice, false)
+	bob := connect(hub, f.bob, false)
+	carol := connect(hub, f.carol, false)
+	subscribe(t, f, alice, bob)
+
+	ack := send(t, bob, Message{RoomID: strconv.Itoa(f.room.ID), Message: "typo"})
+	expect(t, alice, typeMessage)
+
+	tests := []struct {
+		name    string
+		editor  *Client
+		frame   string
+		text    string
+		wantErr string
+	}{
+		{"by a non-member", carol, typeEdit, "hacked", errorForbidden},
+		{"by the sender", bob, typeEdit, "fixed", ""},
+		{"by the room admin", alice, typeEdit, "moderated", ""},
+		{"delete", bob, typeDelete, "", ""},
+		{"edit after delete", bob, typeEdit, "again", errorInvalidMessage},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			submit(test.editor, Envelope{Type: test.frame, Message: &Message{ID: ack.ID, Message: test.text}})
+
+			if test.wantErr != "" {
+				reply := expect(t, test.editor, typeError)
+				if reply.Error.Code != test.wantErr {
+					t.Errorf("error = %+v, want %s", reply.Error, test.wantErr)
+				}
+				expectNothing(t, alice)
+				expectNothing(t, bob)
+				return
+			}
+
+			if reply := expect(t, test.editor, typeAck); reply.ID != ack.ID {
+				t.Errorf("ack = %+v", reply)
+			}
+
+			for _, client := range []*Client{alice, bob} {
+				update := expect(t, client, typeUpdate)
+				if update.Message.ID != ack.ID || update.Message.Message != test.text {
+					t.Errorf("update = %+v, want text %q", update.Message, test.text)
+				}
+				if test.frame == typeDelete && update.Message.DeletedAt == 0 {
+					t.Error("deleted message has no deleted_at")
+				}
+			}
+			expectNothing(t, carol)
+		})
+	}
+}
+
+// An edit stored by prepare is announced even if its sender disconnects
+// before the hub gets to it.
+func TestHubEditOfGoneClient(t *testing.T) {
+	hub, f := newTestHub(t)
+
+	alice := connect(hub, f.alice, false)
+	bob := connect(hub, f.bob, false)
+	subscribe(t, f, alice, bob)
+
+	ack := send(t, bob, Message{RoomID: strconv.Itoa(f.room.ID), Message: "typo"})
+	expect(t, alice, typeMessage)
+
+	in := hub.prepare(bob, Envelope{V: protocolVersion, Type: typeEdit, Message: &Message{ID: ack.ID, Message: "fixed"}})
+	hub.unregister <- bob
+	hub.inbound <- in
+
+	if update := expect(t, alice, typeUpdate); update.Message.ID != ack.ID || update.Message.Message != "fixed" {
+		t.Errorf("update = %+v", update.Message)
+	}
+}
+
+func TestHubReactionFanOut(t *testing.T) {
+	hub, f := newTestHub(t)
+
+	alice := connect(hub, f.alice, false)
+	bob := connect(hub, f.bob, false)
+	bobPhone := connect(hub, f.bob, false)
+	carol := connect(hub, f.carol, false)
+
+	ack := send(t, alice, Message{Receiver: strconv.Itoa(f.bob.ID), Message: "react to this"})
+	for _, client := range []*Client{bob, bobPhone} {
+		expect(t, client, typeMessage)
+	}
+
+	tests := []struct {
+		name      string
+		reactor   *Client
+		frame     string
+		broadcast bool
+		wantErr   string
+	}{
+		{"add", bob, typeReactionAdd, true, ""},
+		{"add again", bob, typeReactionAdd, false, ""},
+		{"remove", bob, typeReactionRemove, true, ""},
+		{"remove again", bob, typeReactionRemove, false, ""},
+		{"outsider", carol, typeReactionAdd, false, errorForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			submit(test.reactor, Envelope{Type: test.frame, Reaction: &Reaction{MessageID: ack.ID, Emoji: "👍"}})
+
+			if test.wantErr != "" {
+				if reply := expect(t, test.reactor, typeError); reply.Error.Code != test.wantErr {
+					t.Errorf("error = %+v, want %s", reply.Error, test.wantErr)
+				}
+			} else {
+				reply := expect(t, test.reactor, typeAck)
+				if reply.Ref != test.frame || reply.Reaction.UserID != strconv.Itoa(f.bob.ID) {
+					t.Errorf("ack = %+v", reply)
+				}
+			}
+
+			for _, client := range []*Client{alice, bob, bobPhone} {
+				if !test.broadcast {
+					expectNothing(t, client)
+					continue
+				}
+
+				reaction := expect(t, client, test.frame)
+				if reaction.Reaction.MessageID != ack.ID || reaction.Reaction.Emoji != "👍" {
+					t.Errorf("reaction = %+v", reaction.Reaction)
+				}
+			}
+			expectNothing(t, carol)
+		})
+	}
+}
+
+func TestHubResume(t *testing.T) {
+	hub, f := newTestHub(t)
+
+	alice := connect(hub, f.alice, false)
+
+	first := send(t, alice, Message{Receiver: strconv.Itoa(f.bob.ID), Message: "seen"})
+	missed := send(t, alice, Message{Receiver: strconv.Itoa(f.bob.ID), Message: "missed"})
+
+	bob := connect(hub, f.bob, true)
+
+	// Held back until bob has resumed.
+	held := send(t, alice, Message{Receiver: strconv.Itoa(f.bob.ID), Message: "held"})
+	expectNothing(t, bob)
+
+	submit(bob, Envelope{Type: typeResume, Resume: &Resume{DMs: map[string]int64{strconv.Itoa(f.alice.ID): first.ID}}})
+
+	// The replay has both missed messages, the held copy is skipped.
+	for _, want := range []int64{missed.ID, held.ID} {
+		if replayed := expect(t, bob, typeMessage); replayed.Message.ID != want {
+			t.Errorf("replayed message %d, want %d", replayed.Message.ID, want)
+		}
+	}
+	if ack := expect(t, bob, typeAck); ack.Ref != typeResume || len(ack.Resume.MoreDMs) != 0 {
+		t.Errorf("resume ack = %+v", ack)
+	}
+	expectNothing(t, bob)
+
+	// Live delivery afterwards.
+	live := send(t, alice, Message{Receiver: strconv.Itoa(f.bob.ID), Message: "live"})
+	if message := expect(t, bob, typeMessage); message.Message.ID != live.ID {
+		t.Errorf("live message %d, want %d", message.Message.ID, live.ID)
+	}
+
+	submit(bob, Envelope{Type: typeResume, Resume: &Resume{}})
+	if reply := expect(t, bob, typeError); reply.Error.Code != errorBadRequest {
+		t.Errorf("second resume: %+v", reply.Error)
+	}
+}
+
+// pausingStore is a memory store whose reads of room history wait after
+// reading the messages until they are released.
+type pausingStore struct {
+	*MemoryStore
+	read    chan bool
+	release chan bool
+}
+
+func (s *pausingStore) roomHistory(roomID int, page historyPage) ([]Message, error) {
+	messages, err := s.MemoryStore.roomHistory(roomID, page)
+	s.read <- true
+	<-s.release
+
+	return messages, err
+}
+
+// A room message sent after the missed messages were read and before the
+// hub has the resume is delivered after the replay.
+func TestHubResumeOfRoomWhileReading(t *testing.T) {
+	store := &pausingStore{MemoryStore: newMemoryStore(), read: make(chan bool), release: make(chan bool)}
+	hub, f := newTestHubOn(t, store)
+
+	alice := connect(hub, f.alice, false)
+	subscribe(t, f, alice)
+	seen := send(t, alice, Message{RoomID: strconv.Itoa(f.room.ID), Message: "seen"})
+
+	bob := connect(hub, f.bob, true)
+	go submit(bob, Envelope{Type: typeResume, Resume: &Resume{Rooms: map[string]int64{strconv.Itoa(f.room.ID): seen.ID}}})
+
+	<-store.read
+	meanwhile := send(t, alice, Message{RoomID: strconv.Itoa(f.room.ID), Message: "meanwhile"})
+	store.release <- true
+
+	if ack := expect(t, bob, typeAck); ack.Ref != typeResume {
+		t.Errorf("resume ack = %+v", ack)
+	}
+	if message := expect(t, bob, typeMessage); message.Message.ID != meanwhile.ID {
+		t.Errorf("message %d after the resume, want %d", message.Message.ID, meanwhile.ID)
+	}
+}
+
+func TestHubResumeOfAnotherRoom(t *testing.T) {
+	hub, f := newTestHub(t)
+
+	carol := connect(hub, f.carol, true)
+	submit(carol, Envelope{Type: typeResume, Resume: &Resume{Rooms: map[string]int64{strconv.Itoa(f.room.ID): 0}}})
+
+	if reply := expect(t, carol, typeError); reply.Error.Code != errorForbidden {
+		t.Errorf("error = %+v, want forbidden", reply.Error)
+	}
+}
+
+// nextPresence returns the next presence frame sent to a client.
+func nextPresence(t *testing.T, client *Client) Presence {
+	t.Helper()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case data := <-client.send:
+			var envelope Envelope
+			if err := json.Unmarshal(data, &envelope); err != nil {
+				t.Fatal(err)
+			}
+			if envelope.Type == typePresence {
+				return *envelope.Presence
+			}
+		case <-timeout:
+			t.Fatal("no presence sent to the client")
+		}
+	}
+}
+
+// Presence goes to the members of shared rooms and to the peers of direct
+// conversations, and to nobody else.
+func TestHubPresence(t *testing.T) {
+	hub, f := newTestHub(t)
+	hub.store.(*MemoryStore).addConversation(f.alice.ID, f.carol.ID)
+
+	bob := connect(hub, f.bob, false)
+	if presence := nextPresence(t, bob); presence.UserID != strconv.Itoa(f.bob.ID) || presence.Status != statusOnline {
+		t.Errorf("own presence = %+v", presence)
+	}
+
+	// Neither is a contact of the other.
+	dave := User{Name: "dave", Email: "dave@example.com"}
+	if err := hub.store.createUser(&dave); err != nil {
+		t.Fatal(err)
+	}
+	stranger := connect(hub, dave, false)
+	nextPresence(t, stranger)
+
+	carol := connect(hub, f.carol, false)
+	nextPresence(t, carol)
+
+	alice := connect(hub, f.alice, false)
+	for _, client := range []*Client{alice, bob, carol} {
+		if presence := nextPresence(t, client); presence.UserID != strconv.Itoa(f.alice.ID) || presence.Status != statusOnline {
+			t.Errorf("presence = %+v, want alice online", presence)
+		}
+	}
+
+	submit(alice, Envelope{Type: typePresence, Presence: &Presence{Status: statusAway}})
+	for _, client := range []*Client{bob, carol} {
+		if presence := nextPresence(t, client); presence.UserID != strconv.Itoa(f.alice.ID) || presence.Status != statusAway {
+			t.Errorf("presence = %+v, want alice away", presence)
+		}
+	}
+
+	hub.unregister <- alice
+	if presence := nextPresence(t, carol); presence.Status != statusOffline || presence.LastSeen == "" {
+		t.Errorf("presence = %+v, want alice offline with last_seen", presence)
+	}
+
+	select {
+	case data := <-stranger.send:
+		t.Errorf("a stranger was sent %s", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHubTyping(t *testing.T) {
+	hub, f := newTestHub(t)
+
+	alice := connect(hub, f.alice, false)
+	bob := connect(hub, f.bob, false)
+	carol := connect(hub, f.carol, false)
+	subscribe(t, f, alice, bob)
+
+	hub.store.(*MemoryStore).addConversation(f.alice.ID, f.bob.ID)
+
+	tests := []struct {
+		name    string
+		frame   string
+		typing  Typing
+		relayTo *Client
+		wantErr string
+	}{
+		{"in the room", typeTypingStart, Typing{RoomID: strconv.Itoa(f.room.ID)}, bob, ""},
+		{"again in the room", typeTypingStart, Typing{RoomID: strconv.Itoa(f.room.ID)}, nil, ""},
+		{"stop in the room", typeTypingStop, Typing{RoomID: strconv.Itoa(f.room.ID)}, bob, ""},
+		{"to a peer", typeTypingStart, Typing{Receiver: strconv.Itoa(f.bob.ID)}, bob, ""},
+		{"to a stranger", typeTypingStart, Typing{Receiver: strconv.Itoa(f.carol.ID)}, nil, errorForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			submit(alice, Envelope{Type: test.frame, Typing: &test.typing})
+
+			if test.wantErr != "" {
+				if reply := expect(t, alice, typeError); reply.Error.Code != test.wantErr {
+					t.Errorf("error = %+v, want %s", reply.Error, test.wantErr)
+				}
+			}
+
+			if test.relayTo != nil {
+				relayed := expect(t, test.relayTo, test.frame)
+				if relayed.Typing.UserID != strconv.Itoa(f.alice.ID) {
+					t.Errorf("typing = %+v", relayed.Typing)
+				}
+			}
+
+			for _, client := range []*Client{alice, bob, carol} {
+				expectNothing(t, client)
+			}
+		})
+	}
+}
+
+func TestHubTypingExpires(t *testing.T) {
+	defer func(timeout int) { config.Typing.TimeoutSeconds = timeout }(config.Typing.TimeoutSeconds)
+	config.Typing.TimeoutSeconds = 1
+
+	hub, f := newTestHub(t)
+
+	alice := connect(hub, f.alice, false)
+	bob := connect(hub, f.bob, false)
+	subscribe(t, f, alice, bob)
+
+	submit(alice, Envelope{Type: typeTypingStart, Typing: &Typing{RoomID: strconv.Itoa(f.room.ID)}})
+	expect(t, bob, typeTypingStart)
+
+	// The timeout and the check period are a second each.
+	start := time.Now()
+	for {
+		select {
+		case data := <-bob.send:
+			var envelope Envelope
+			json.Unmarshal(data, &envelope)
+			if envelope.Type == typeTypingStop {
+				if elapsed := time.Since(start); elapsed < time.Second {
+					t.Errorf("typing stopped after %v", elapsed)
+				}
+				return
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("typing did not expire")
+		}
+	}
+}
+
+func TestHubTypingRateLimit(t *testing.T) {
+	defer func(limit int) { config.Typing.MaxPerMinute = limit }(config.Typing.MaxPerMinute)
+	config.Typing.MaxPerMinute = 2
+
+	hub, f := newTestHub(t)
+
+	alice := connect(hub, f.alice, false)
+	subscribe(t, f, alice)
+
+	typing := Envelope{Type: typeTypingStart, Typing: &Typing{RoomID: strconv.Itoa(f.room.ID)}}
+	for i := 0; i < 2; i++ {
+		submit(alice, typing)
+	}
+	expectNothing(t, alice)
+
+	submit(alice, typing)
+	if reply := expect(t, alice, typeError); reply.Error.Code != errorRateLimited {
+		t.Errorf("error = %+v, want rate limited", reply.Error)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+
+	// Register the GIF decoder for image.Decode.
+	_ "image/gif"
+)
+
+// Largest image decoded, in pixels. Bigger images are not thumbnailed so
+// that a small file cannot claim gigabytes of memory.
+const maxImagePixels = 40 << 20
+
+// errImageTooLarge is returned for images with more than maxImagePixels
+// pixels.
+var errImageTooLarge = errors.New("image is too large")
+
+// decodeImage decodes a JPEG, PNG or GIF image and returns it with its
+// format name.
+func decodeImage(data []byte) (image.Image, string, error) {
+	imageConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if imageConfig.Width*imageConfig.Height > maxImagePixels {
+		return nil, "", errImageTooLarge
+	}
+
+	return image.Decode(bytes.NewReader(data))
+}
+
+// fitImage scales an image down to fit in a size x size square, keeping its
+// aspect ratio. Smaller images are returned as they are.
+func fitImage(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return src
+	}
+
+	if width > height {
+		width, height = size, max(1, height*size/width)
+	} else {
+		width, height = max(1, width*size/height), size
+	}
+
+	return scaleImage(src, bounds, width, height)
+}
+
+// scaleImage scales the part of src inside bounds down to width x height by
+// averaging the source pixels covered by each target pixel.
+func scaleImage(src image.Image, bounds image.Rectangle, width int, height int) *image.RGBA {
+	return scaleRGBA(rgbaImage(src, bounds), width, height)
+}
+
+// rgbaImage returns the part of src inside bounds as an RGBA image. Scaling
+// one source to several sizes should convert it only once. RGBA sources are
+// not copied.
+func rgbaImage(src image.Image, bounds image.Rectangle) *image.RGBA {
+	if rgba, ok := src.(*image.RGBA); ok {
+		return rgba.SubImage(bounds).(*image.RGBA)
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+
+	return rgba
+}
+
+// scaleRGBA scales source down to width x height by averaging the source
+// pixels covered by each target pixel.
+func scaleRGBA(source *image.RGBA, width int, height int) *image.RGBA {
+	sourceWidth, sourceHeight := source.Rect.Dx(), source.Rect.Dy()
+
+	target := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * sourceHeight / height
+		y1 := max(y0+1, (y+1)*sourceHeight/height)
+
+		for x := 0; x < width; x++ {
+			x0 := x * sourceWidth / width
+			x1 := max(x0+1, (x+1)*sourceWidth/width)
+
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := source.Pix[sy*source.Stride+x0*4 : sy*source.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+
+			count := (x1 - x0) * (y1 - y0)
+			offset := y*target.Stride + x*4
+			for i := range sum {
+				target.Pix[offset+i] = uint8(sum[i] / count)
+			}
+		}
+	}
+
+	return target
+}
+
+// encodeImage encodes an image as JPEG if the original was a JPEG and as PNG
+// otherwise, keeping transparency. It returns the data and its content type.
+func encodeImage(img image.Image, format string) ([]byte, string, error) {
+	var buffer bytes.Buffer
+
+	if format == "jpeg" {
+		err := jpeg.Encode(&buffer, img, &jpeg.Options{Quality: 85})
+		return buffer.Bytes(), "image/jpeg", err
+	}
+
+	err := png.Encode(&buffer, img)
+
+	return buffer.Bytes(), "image/png", err
+}
@@ -5,15 +5,12 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
-	"strconv"
 )
 
-var addr = flag.String("addr", ":8000", "http service address")
-
 func serveHome(w http.ResponseWriter, r *http.Request) {
 	log.Println(r.URL)
 
@@ -29,199 +26,224 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	http.ServeFile(w, r, "public/build/index.html")
+	http.ServeFile(w, r, config.Static.IndexFile)
 }
 
 func main() {
-	var migrate bool
-	flag.BoolVar(&migrate, "migrate", false, "Whether or not you want to run the database migration.")
-
 	flag.Parse()
 
-	dbconn := newHalooDB(migrate)
-	dbconn.connect()
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	config = cfg
 
-	rooms := getRooms(dbconn)
+	// haloo-chat config print
+	if flag.Arg(0) == "config" {
+		if flag.Arg(1) != "print" {
+			log.Fatal("usage: config print")
+		}
+		if err := config.print(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	go dbconn.queuePump()
+	// haloo-chat migrate up|down|status|to N
+	if flag.Arg(0) == "migrate" {
+		dbconn := newHalooDB(false)
+		if err := dbconn.connect(); err != nil {
+			log.Fatal(err)
+		}
 
-	hub := newHub(dbconn)
-	go hub.run()
+		err := runMigrateCommand(dbconn.connection, flag.Args()[1:])
+		dbconn.close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	http.HandleFunc("/chat", serveHome)
+	upgrader.ReadBufferSize = config.Limits.ReadBufferSize
+	upgrader.WriteBufferSize = config.Limits.WriteBufferSize
 
-	// Start serving websockets for all rooms
-	for _, room := range rooms {
-		roomHub := newHub(dbconn)
-		go roomHub.run()
+	var store Store
+	switch config.Store {
+	case "postgres":
+		dbconn := newHalooDB(config.Database.Migrate)
+		if err := dbconn.connect(); err != nil {
+			log.Fatal(err)
+		}
+		defer dbconn.close()
 
-		http.HandleFunc("/"+strconv.Itoa(room.ID), func(w http.ResponseWriter, r *http.Request) {
-			serveWs(roomHub, w, r)
-		})
+		store = newPostgresStore(dbconn.connection)
+	case "memory":
+		memoryStore := newMemoryStore()
+		if config.Features.SeedMemoryStore {
+			seedMemoryStore(memoryStore)
+		}
+		store = memoryStore
+	}
+
+	auth := newAuthenticator(config.Secret, store)
+
+	blobs, err := newBlobStore(config.Attachments)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pictures, err := newLocalBlobStore(config.Pictures.Dir)
+	if err != nil {
+		log.Fatal(err)
 	}
 
+	go sweepAttachments(store, blobs)
+
+	persister := newPersister(store)
+	go persister.run()
+
+	hub := newHub(store, persister)
+	go hub.run()
+
+	http.HandleFunc("/chat", serveHome)
+
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		serveWs(hub, w, r)
+		serveWs(hub, auth, w, r)
 	})
 
-	// Serve Javascript and CSS files
-	fs := http.FileServer(http.Dir("public/build/static"))
-	http.Handle("/static/", http.StripPrefix("/static", fs))
-
-	// Get all rooms and conversations for one user so that they can be displayed in the UI
-	http.HandleFunc("/conversations", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
+	http.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		serveLogin(store, auth, w, r)
+	})
 
-		type UserConversationInfo struct {
-			Conversations []User `json:"conversations"`
-			Rooms         []Room `json:"rooms"`
+	http.HandleFunc("POST /users", func(w http.ResponseWriter, r *http.Request) {
+		if !config.Features.Registration {
+			writeJSONError(w, 403, "Registration is disabled")
+			return
 		}
+		serveCreateUser(store, w, r)
+	})
+
+	http.HandleFunc("PATCH /users/{id}", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveUpdateUser(store, w, r, userID)
+	}))
+
+	http.HandleFunc("PUT /users/{id}/picture", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveUserPicture(store, pictures, w, r, userID)
+	}))
 
-		log.Println(r.URL)
+	http.HandleFunc("DELETE /users/{id}", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveDeleteUser(hub, blobs, w, r, userID)
+	}))
 
-		if r.Method != "GET" {
-			http.Error(w, "Method not allowed", 405)
+	http.HandleFunc("POST /rooms", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		if !config.Features.RoomCreation {
+			writeJSONError(w, 403, "Room creation is disabled")
 			return
 		}
+		serveCreateRoom(hub, w, r, userID)
+	}))
 
-		// User ID comes in query parameter user_id
-		userIds, ok := r.URL.Query()["user_id"]
+	http.HandleFunc("PATCH /rooms/{id}", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveUpdateRoom(store, w, r, userID)
+	}))
 
-		if !ok || len(userIds) < 1 {
-			log.Printf("no user_id provided for getting conversations & rooms")
-			// TODO: Return JSON stating the error.
-		}
+	http.HandleFunc("PUT /rooms/{id}/picture", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveRoomPicture(store, pictures, w, r, userID)
+	}))
 
-		// There should only be one user_id coming from the request
-		strID := userIds[0]
+	http.HandleFunc("GET /pictures/{name}", func(w http.ResponseWriter, r *http.Request) {
+		servePicture(pictures, w, r)
+	})
 
-		userID, err := strconv.Atoi(strID)
-		if err != nil {
-			log.Printf("error converting userid to integer: %v", err)
-		}
-		user := getUser(dbconn, userID)
+	http.HandleFunc("POST /rooms/{id}/members", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveAddRoomMember(hub, w, r, userID)
+	}))
 
-		log.Printf("User id is: %v", user.ID)
+	http.HandleFunc("DELETE /rooms/{id}/members/{user}", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveRemoveRoomMember(hub, w, r, userID)
+	}))
 
-		// Conversations with other users
-		conversations := user.getConversations()
+	// Serve Javascript and CSS files
+	fs := http.FileServer(http.Dir(config.Static.AssetsDir))
+	http.Handle("/static/", http.StripPrefix("/static", fs))
 
-		// Rooms user is in
-		rooms := user.getRooms()
+	// Get all rooms and conversations for one user so that they can be displayed in the UI
+	http.HandleFunc("/conversations", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveConversations(store, w, r, userID)
+	}))
 
-		log.Printf("rooms: %v", rooms)
+	http.HandleFunc("GET /rooms/{id}/messages", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveRoomHistory(store, w, r, userID)
+	}))
 
-		// Bundle user conversations and rooms into one JSON data
-		var conversationInfo UserConversationInfo
-		conversationInfo.Conversations = conversations
-		conversationInfo.Rooms = rooms
+	http.HandleFunc("GET /dms/{peer}/messages", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveDirectHistory(store, w, r, userID)
+	}))
 
-		log.Printf("conversation info: %v", conversationInfo)
+	http.HandleFunc("POST /rooms/{id}/read", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveMarkRoomRead(hub, store, w, r, userID)
+	}))
 
-		conversationJSON, err := json.Marshal(conversationInfo)
-		if err != nil {
-			log.Printf("error converting conversations to JSON: %v", err)
-		}
+	http.HandleFunc("POST /dms/{peer}/read", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveMarkDirectRead(hub, store, w, r, userID)
+	}))
 
-		// Return JSON for user
-		w.Write(conversationJSON)
-	})
+	http.HandleFunc("PATCH /messages/{id}", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveEditMessage(hub, store, w, r, userID)
+	}))
 
-	http.HandleFunc("/chatlog", func(w http.ResponseWriter, r *http.Request) {
-		type ChatlogJSON struct {
-			Sender    string `json:"sender"`
-			Receiver  string `json:"receiver"`
-			Message   string `json:"message"`
-			RoomID    int    `json:"room_id"`
-			Timestamp int64  `json:"timestamp"`
-			Name      string `json:"name"`
-		}
+	http.HandleFunc("DELETE /messages/{id}", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveDeleteMessage(hub, store, w, r, userID)
+	}))
 
-		var chatData []ChatlogJSON
+	http.HandleFunc("GET /messages/{id}/edits", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveMessageEdits(store, w, r, userID)
+	}))
 
-		w.Header().Set("Content-Type", "application/json")
+	http.HandleFunc("GET /messages/{id}/thread", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveThread(store, w, r, userID)
+	}))
 
-		log.Println(r.URL)
+	http.HandleFunc("POST /attachments", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveUploadAttachment(store, blobs, w, r, userID)
+	}))
 
-		if r.Method != "GET" {
-			http.Error(w, "Method not allowed", 405)
-			return
-		}
+	http.HandleFunc("GET /attachments/{id}", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveAttachment(store, blobs, w, r, userID, false)
+	}))
 
-		roomID, ok := r.URL.Query()["room_id"]
-		if !ok || len(roomID) < 1 {
-			userID, ok := r.URL.Query()["user_id"]
-			if !ok || len(userID) < 1 {
-				log.Printf("no user_id provided for getting conversations & rooms")
-				// TODO: Return JSON stating the error.
-			}
-
-			receiverID, ok := r.URL.Query()["receiver_id"]
-			if !ok || len(receiverID) < 1 {
-				log.Printf("no receiver_id provided for getting conversations & rooms")
-				// TODO: Return JSON stating the error.
-			}
-
-			rows, err := dbconn.connection.Query("SELECT c.sender, c.receiver, c.message, c.timestamp, cu.name FROM chatlog c JOIN chat_users cu ON cu.id = c.sender WHERE ((sender = $1) AND (receiver = $2)) AND (room_id IS NULL);", userID[0], receiverID[0])
-			if err != nil {
-				log.Printf("error reading chatlog for user: %v", err)
-			}
-
-			defer rows.Close()
-			for rows.Next() {
-				var cData ChatlogJSON
-				if err := rows.Scan(&cData.Sender, &cData.Receiver, &cData.Message, &cData.Timestamp, &cData.Name); err != nil {
-					log.Printf("error reading chatlog data %v", err)
-				}
-
-				chatData = append(chatData, cData)
-			}
-
-			rows, err = dbconn.connection.Query("SELECT c.sender, c.receiver, c.message, c.timestamp, cu.name FROM chatlog c JOIN chat_users cu ON cu.id = c.receiver WHERE ((sender = $1) AND (receiver = $2)) AND (room_id IS NULL);", receiverID[0], userID[0])
-			if err != nil {
-				log.Printf("error reading chatlog for user: %v", err)
-			}
-
-			defer rows.Close()
-			for rows.Next() {
-				var cData ChatlogJSON
-				if err := rows.Scan(&cData.Sender, &cData.Receiver, &cData.Message, &cData.Timestamp, &cData.Name); err != nil {
-					log.Printf("error reading chatlog data %v", err)
-				}
-
-				chatData = append(chatData, cData)
-			}
-		} else {
-			rows, err := dbconn.connection.Query("SELECT sender, receiver, message, room_id, timestamp FROM chatlog WHERE room_id = $1", roomID[0])
-			if err != nil {
-				log.Printf("error reading chatlog for room: %v", err)
-			}
-
-			log.Printf("rows: %v", rows)
-
-			defer rows.Close()
-			for rows.Next() {
-				var cData ChatlogJSON
-				if err := rows.Scan(&cData.Sender, &cData.Receiver, &cData.Message, &cData.RoomID, &cData.Timestamp); err != nil {
-					log.Printf("error reading chatlog data: %v", err)
-				}
-
-				chatData = append(chatData, cData)
-			}
-		}
+	http.HandleFunc("GET /attachments/{id}/thumbnail", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveAttachment(store, blobs, w, r, userID, true)
+	}))
 
-		log.Printf("chat data: %v", chatData)
+	http.HandleFunc("GET /search", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveSearch(store, w, r, userID)
+	}))
 
-		chatDataJSON, err := json.Marshal(chatData)
-		if err != nil {
-			log.Printf("error converting json: %v", err)
-		}
+	http.HandleFunc("GET /presence", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		servePresence(hub, w, r, userID)
+	}))
 
-		w.Write(chatDataJSON)
-	})
+	http.HandleFunc("/chatlog", auth.requireAuth(func(w http.ResponseWriter, r *http.Request, userID int) {
+		serveChatlog(store, w, r, userID)
+	}))
 
-	err := http.ListenAndServe(*addr, nil)
-	if err != nil {
+	server := &http.Server{Addr: config.Addr}
+
+	stopped := make(chan bool)
+	go shutdownOnSignal(server, hub, stopped)
+
+	fmt.Println("*** HALOO CHAT RUNNING! :) ***")
+
+	if config.TLS.CertFile != "" {
+		err = server.ListenAndServeTLS(config.TLS.CertFile, config.TLS.KeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
 		log.Fatal("ListenAndServe: ", err)
 	}
+
+	// Wait for the clients to be drained before closing the database.
+	<-stopped
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Wait before loading the members of a room again after an error.
+const membersRetryDelay = 5 * time.Second
+
+// memberCache caches the members of rooms. It is shared by the hub and the
+// readPumps of the clients, so it is safe for concurrent use.
+type memberCache struct {
+	store Store
+
+	mu sync.Mutex
+
+	// Room ID -> set of member user IDs. The sets are never modified.
+	rooms map[int]map[int]bool
+
+	// Incremented by every invalidation so that members loaded before it
+	// are not cached.
+	version int
+}
+
+func newMemberCache(store Store) *memberCache {
+	return &memberCache{store: store, rooms: make(map[int]map[int]bool)}
+}
+
+// get returns the member user IDs of a room, loading them from the store
+// the first time the room is seen. Rooms that do not exist have no members.
+func (c *memberCache) get(roomID int) (map[int]bool, error) {
+	c.mu.Lock()
+	members, ok := c.rooms[roomID]
+	version := c.version
+	c.mu.Unlock()
+
+	if ok {
+		return members, nil
+	}
+
+	memberIDs, err := c.store.roomMembers(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	members = make(map[int]bool)
+	for _, userID := range memberIDs {
+		members[userID] = true
+	}
+
+	// A room that does not exist yet is not cached, it may be created with
+	// this ID.
+	if len(members) == 0 {
+		if _, err := c.store.getRoom(roomID); err != nil {
+			if err == errNotFound {
+				return members, nil
+			}
+			return nil, err
+		}
+	}
+
+	c.mu.Lock()
+	if c.version == version {
+		c.rooms[roomID] = members
+	}
+	c.mu.Unlock()
+
+	return members, nil
+}
+
+// cached returns the members of a room if they are cached, without going to
+// the store.
+func (c *memberCache) cached(roomID int) (map[int]bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	members, ok := c.rooms[roomID]
+
+	return members, ok
+}
+
+// invalidate drops the cached members of a room after they have changed.
+func (c *memberCache) invalidate(roomID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.rooms, roomID)
+	c.version++
+}
+
+// isMember checks whether a user is a member of a room.
+func (c *memberCache) isMember(roomID int, userID int) (bool, error) {
+	members, err := c.get(roomID)
+
+	return members[userID], err
+}
+
+// canRead checks whether a user is a participant of the conversation a
+// message belongs to.
+func (c *memberCache) canRead(userID int, message Message) (bool, error) {
+	if message.RoomID != "" {
+		roomID, _ := strconv.Atoi(message.RoomID)
+		return c.isMember(roomID, userID)
+	}
+
+	user := strconv.Itoa(userID)
+
+	return message.Sender == user || message.Receiver == user, nil
+}
+
+// contacts returns the users who see the presence of the given user: their
+// conversation partners and the members of their rooms.
+func (c *memberCache) contacts(userID int) (map[int]bool, error) {
+	contacts := make(map[int]bool)
+
+	conversations, err := c.store.conversations(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, peer := range conversations {
+		contacts[peer.ID] = true
+	}
+
+	rooms, err := c.store.userRooms(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, room := range rooms {
+		members, err := c.get(room.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		for memberID := range members {
+			contacts[memberID] = true
+		}
+	}
+
+	delete(contacts, userID)
+
+	return contacts, nil
+}
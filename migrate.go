@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Migration file names look like 0001_create_tables.up.sql.
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// migration is one numbered schema change with its up and down SQL.
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// checksum identifies the contents of the up migration so that edits made
+// after it was applied can be detected.
+func (m migration) checksum() string {
+	sum := sha256.Sum256([]byte(m.up))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// appliedMigration is a row of the schema_migrations table.
+type appliedMigration struct {
+	version   int
+	name      string
+	checksum  string
+	appliedAt string
+}
+
+// Migrator applies and reverts the migrations of a directory and records
+// them in the schema_migrations table.
+type Migrator struct {
+	db         *sql.DB
+	dir        string
+	migrations []migration
+}
+
+func newMigrator(db *sql.DB, dir string) (*Migrator, error) {
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INT8 PRIMARY KEY, name STRING NOT NULL, checksum STRING NOT NULL, applied_at TIMESTAMPTZ NOT NULL DEFAULT now());"); err != nil {
+		return nil, err
+	}
+
+	return &Migrator{db: db, dir: dir, migrations: migrations}, nil
+}
+
+// loadMigrations reads the migration files of a directory sorted by version.
+// Every version must have both an up and a down file.
+func loadMigrations(dir string) ([]migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, file := range files {
+		match := migrationFile.FindStringSubmatch(file.Name())
+		if match == nil {
+			continue
+		}
+
+		version, _ := strconv.Atoi(match[1])
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: match[2]}
+			byVersion[version] = m
+		} else if m.name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.up = string(data)
+		} else {
+			m.down = string(data)
+		}
+	}
+
+	var migrations []migration
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+
+	return migrations, nil
+}
+
+// applied returns the migrations recorded in schema_migrations by version.
+func (mg *Migrator) applied() (map[int]appliedMigration, error) {
+	applied := make(map[int]appliedMigration)
+
+	rows, err := mg.db.Query("SELECT version, name, checksum, applied_at::STRING FROM schema_migrations;")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var a appliedMigration
+		if err := rows.Scan(&a.version, &a.name, &a.checksum, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[a.version] = a
+	}
+
+	return applied, rows.Err()
+}
+
+// verify checks that every applied migration still exists with the checksum
+// it had when it was applied.
+func (mg *Migrator) verify(applied map[int]appliedMigration) error {
+	known := make(map[int]migration)
+	for _, m := range mg.migrations {
+		known[m.version] = m
+	}
+
+	for version, a := range applied {
+		m, ok := known[version]
+		if !ok {
+			return fmt.Errorf("applied migration %d_%s is missing from %s", version, a.name, mg.dir)
+		}
+
+		if m.checksum() != a.checksum {
+			return fmt.Errorf("migration %d_%s was edited after it was applied", version, m.name)
+		}
+	}
+
+	return nil
+}
+
+// current returns the highest applied version, or 0 if nothing is applied.
+func current(applied map[int]appliedMigration) int {
+	version := 0
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+
+	return version
+}
+
+// latest returns the highest known version.
+func (mg *Migrator) latest() int {
+	if len(mg.migrations) == 0 {
+		return 0
+	}
+
+	return mg.migrations[len(mg.migrations)-1].version
+}
+
+// up applies every pending migration.
+func (mg *Migrator) up() error {
+	return mg.to(mg.latest())
+}
+
+// down reverts the most recently applied migration.
+func (mg *Migrator) down() error {
+	applied, err := mg.applied()
+	if err != nil {
+		return err
+	}
+
+	version := current(applied)
+	if version == 0 {
+		return errors.New("no migrations to revert")
+	}
+
+	// Revert to the highest applied version below the current one.
+	target := 0
+	for v := range applied {
+		if v < version && v > target {
+			target = v
+		}
+	}
+
+	return mg.to(target)
+}
+
+// to applies or reverts migrations until exactly the migrations up to and
+// including version are applied.
+func (mg *Migrator) to(version int) error {
+	applied, err := mg.applied()
+	if err != nil {
+		return err
+	}
+
+	if err := mg.verify(applied); err != nil {
+		return err
+	}
+
+	if version != 0 && !mg.exists(version) {
+		return fmt.Errorf("unknown migration version %d", version)
+	}
+
+	for _, m := range mg.migrations {
+		if _, ok := applied[m.version]; !ok && m.version <= version {
+			if err := mg.apply(m, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := len(mg.migrations) - 1; i >= 0; i-- {
+		m := mg.migrations[i]
+		if _, ok := applied[m.version]; ok && m.version > version {
+			if err := mg.apply(m, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (mg *Migrator) exists(version int) bool {
+	for _, m := range mg.migrations {
+		if m.version == version {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apply runs the up or down SQL of one migration and records it, both in
+// the same transaction.
+func (mg *Migrator) apply(m migration, up bool) error {
+	tx, err := mg.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if up {
+		_, err = tx.Exec(m.up)
+		if err == nil {
+			_, err = tx.Exec("INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3);", m.version, m.name, m.checksum())
+		}
+	} else {
+		_, err = tx.Exec(m.down)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM schema_migrations WHERE version = $1;", m.version)
+		}
+	}
+
+	direction := "up"
+	if !up {
+		direction = "down"
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %d_%s %s failed: %v", m.version, m.name, direction, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("migration %d_%s %s failed: %v", m.version, m.name, direction, err)
+	}
+
+	fmt.Printf("migrated %s: %d_%s\n", direction, m.version, m.name)
+
+	return nil
+}
+
+// status prints every known migration and whether it has been applied.
+func (mg *Migrator) status() error {
+	applied, err := mg.applied()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range mg.migrations {
+		state := "pending"
+		if a, ok := applied[m.version]; ok {
+			state = "applied " + a.appliedAt
+			if a.checksum != m.checksum() {
+				state += " (EDITED AFTER APPLYING)"
+			}
+		}
+
+		fmt.Printf("%04d_%s\t%s\n", m.version, m.name, state)
+	}
+
+	if err := mg.verify(applied); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// runMigrateCommand handles "migrate up|down|status|to N".
+func runMigrateCommand(db *sql.DB, args []string) error {
+	mg, err := newMigrator(db, config.Database.MigrationsDir)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return errors.New("usage: migrate up|down|status|to N")
+	}
+
+	switch args[0] {
+	case "up":
+		return mg.up()
+	case "down":
+		return mg.down()
+	case "status":
+		return mg.status()
+	case "to":
+		if len(args) < 2 {
+			return errors.New("usage: migrate to N")
+		}
+
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid migration version %q", args[1])
+		}
+
+		return mg.to(version)
+	}
+
+	return errors.New("usage: migrate up|down|status|to N")
+}
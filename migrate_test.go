@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeMigrations writes files with their names as contents to a new
+// directory.
+func writeMigrations(t *testing.T, names ...string) string {
+	dir := t.TempDir()
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestLoadMigrations(t *testing.T) {
+	dir := writeMigrations(t,
+		"0002_second.up.sql", "0002_second.down.sql",
+		"0001_first.down.sql", "0001_first.up.sql",
+		"README.md",
+	)
+
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrations) != 2 || migrations[0].version != 1 || migrations[1].version != 2 {
+		t.Fatalf("migrations = %+v, want 1 and 2", migrations)
+	}
+	if migrations[0].name != "first" || migrations[0].up != "0001_first.up.sql" || migrations[0].down != "0001_first.down.sql" {
+		t.Errorf("migration 1 = %+v", migrations[0])
+	}
+
+	if _, err := loadMigrations(writeMigrations(t, "0001_first.up.sql")); err == nil {
+		t.Error("loading a migration without a down file succeeded")
+	}
+	if _, err := loadMigrations(writeMigrations(t, "0001_first.up.sql", "0001_other.down.sql")); err == nil {
+		t.Error("loading a migration with two names succeeded")
+	}
+}
+
+// The migrations shipped with the server load and are numbered without
+// gaps.
+func TestShippedMigrations(t *testing.T) {
+	migrations, err := loadMigrations("database/migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %d_%s, want version %d", m.version, m.name, i+1)
+		}
+	}
+}
+
+func TestVerifyMigrations(t *testing.T) {
+	mg := &Migrator{dir: "migrations", migrations: []migration{
+		{version: 1, name: "first", up: "CREATE TABLE a ();"},
+		{version: 2, name: "second", up: "CREATE TABLE b ();"},
+	}}
+
+	applied := map[int]appliedMigration{
+		1: {version: 1, name: "first", checksum: mg.migrations[0].checksum()},
+	}
+	if err := mg.verify(applied); err != nil {
+		t.Errorf("verify = %v", err)
+	}
+	if current(applied) != 1 || current(nil) != 0 {
+		t.Errorf("current = %v, %v, want 1, 0", current(applied), current(nil))
+	}
+
+	applied[2] = appliedMigration{version: 2, name: "second", checksum: migration{up: "CREATE TABLE c ();"}.checksum()}
+	if err := mg.verify(applied); err == nil || !strings.Contains(err.Error(), "edited") {
+		t.Errorf("verify of an edited migration = %v", err)
+	}
+
+	delete(applied, 2)
+	applied[3] = appliedMigration{version: 3, name: "third"}
+	if err := mg.verify(applied); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("verify of a missing migration = %v", err)
+	}
+}
+
+// Every shipped migration can be reverted and applied again.
+func TestMigrateDownAndUp(t *testing.T) {
+	db := openTestDB(t)
+
+	mg, err := newMigrator(db, "database/migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mg.up(); err != nil {
+		t.Fatal(err)
+	}
+
+	for version := mg.latest(); version > 0; version-- {
+		if err := mg.down(); err != nil {
+			t.Fatal(err)
+		}
+
+		applied, err := mg.applied()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current(applied) != version-1 {
+			t.Fatalf("after reverting %d current = %d", version, current(applied))
+		}
+	}
+
+	if err := mg.down(); err == nil {
+		t.Error("reverting with nothing applied succeeded")
+	}
+
+	if err := mg.up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mg.to(mg.latest() + 1); err == nil {
+		t.Error("migrating to an unknown version succeeded")
+	}
+}
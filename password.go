@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// hashPassword hashes a password with bcrypt using the configured cost.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), config.Limits.BcryptCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// isPasswordHashed reports whether a stored password is a bcrypt hash rather
+// than a plaintext password from before hashing was introduced.
+func isPasswordHashed(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// verifyPassword checks a password against the stored value. The second
+// return value reports whether the stored value should be rehashed, either
+// because it is still in plaintext or because it uses an outdated cost.
+func verifyPassword(stored string, password string) (bool, bool) {
+	// Users without a password cannot log in.
+	if stored == "" {
+		return false, false
+	}
+
+	if !isPasswordHashed(stored) {
+		ok := subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)); err != nil {
+		return false, false
+	}
+
+	cost, err := bcrypt.Cost([]byte(stored))
+	if err != nil {
+		log.Printf("error reading bcrypt cost: %v", err)
+		return true, false
+	}
+
+	return true, cost != config.Limits.BcryptCost
+}
+
+// rehashPassword stores a freshly hashed password for a user.
+func rehashPassword(store Store, userID int, password string) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("error hashing password: %v", err)
+		return
+	}
+
+	if err := store.setPassword(userID, hash); err != nil {
+		log.Printf("error updating password hash: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	hash, err := hashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isPasswordHashed(hash) {
+		t.Fatalf("hashPassword = %q, want a bcrypt hash", hash)
+	}
+
+	cheap, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		stored   string
+		password string
+		valid    bool
+		rehash   bool
+	}{
+		{"hash", hash, "hunter2", true, false},
+		{"wrong password for hash", hash, "hunter3", false, false},
+		{"outdated cost", string(cheap), "hunter2", true, true},
+		{"plaintext", "hunter2", "hunter2", true, true},
+		{"wrong password for plaintext", "hunter2", "hunter3", false, false},
+		{"no password", "", "", false, false},
+	}
+
+	for _, test := range tests {
+		valid, rehash := verifyPassword(test.stored, test.password)
+		if valid != test.valid || rehash != test.rehash {
+			t.Errorf("%s: verifyPassword = %v, %v, want %v, %v", test.name, valid, rehash, test.valid, test.rehash)
+		}
+	}
+}
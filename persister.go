@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Wait before the first retry of a batch. Doubled on every retry. The queue
+// size, batch size and number of retries come from the config.
+const retryBackoff = 50 * time.Millisecond
+
+// persistRequest asks the persister to insert a message to the chatlog.
+type persistRequest struct {
+	message Message
+
+	// Client that sent the message and the ID it gave to it.
+	client      *Client
+	clientMsgID string
+
+	// Users the hub tells about the message when it is a reply to a room
+	// thread.
+	threadRecipients []int
+
+	// Channel the result is reported to.
+	done chan persistResult
+}
+
+// persistResult is the outcome of a persistRequest. On success the message
+// carries its chatlog ID.
+type persistResult struct {
+	request persistRequest
+	err     error
+}
+
+// Persister writes chat messages to the chatlog in batches. Results are only
+// reported after the transaction holding the message has committed.
+type Persister struct {
+	store Store
+
+	// Bounded queue of messages waiting to be written. When it is full new
+	// messages are rejected as busy.
+	queue chan persistRequest
+
+	// Closed when the queue has been closed and everything in it written.
+	stopped chan bool
+}
+
+func newPersister(store Store) *Persister {
+	return &Persister{
+		store:   store,
+		queue:   make(chan persistRequest, config.Limits.QueueSize),
+		stopped: make(chan bool),
+	}
+}
+
+// enqueue adds a request to the queue without blocking. It returns false if
+// the queue is full.
+func (p *Persister) enqueue(request persistRequest) bool {
+	select {
+	case p.queue <- request:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the persister once the requests already queued are written.
+// Nothing may be enqueued after it.
+func (p *Persister) close() {
+	close(p.queue)
+}
+
+func (p *Persister) run() {
+	defer close(p.stopped)
+
+	for request := range p.queue {
+		// Take whatever else is already waiting into the same batch.
+		batch := []persistRequest{request}
+		for len(batch) < config.Limits.MaxBatchSize && len(p.queue) > 0 {
+			batch = append(batch, <-p.queue)
+		}
+
+		p.write(batch)
+	}
+}
+
+// write inserts a batch and reports the result of every message in it. If
+// the batch fails for a reason other than a transient error, its messages
+// are written one by one so that one bad message does not fail the rest.
+func (p *Persister) write(batch []persistRequest) {
+	ids, err := p.insertWithRetry(batch)
+	if err == nil {
+		for i, request := range batch {
+			request.message.ID = ids[i]
+			request.done <- persistResult{request: request}
+		}
+		return
+	}
+
+	if len(batch) == 1 {
+		log.Printf("error inserting message to db: %v", err)
+		batch[0].done <- persistResult{request: batch[0], err: err}
+		return
+	}
+
+	for _, request := range batch {
+		p.write([]persistRequest{request})
+	}
+}
+
+func (p *Persister) insertWithRetry(batch []persistRequest) ([]int64, error) {
+	backoff := retryBackoff
+
+	for attempt := 0; ; attempt++ {
+		ids, err := p.insert(batch)
+		if err == nil || attempt == config.Limits.MaxRetries || !isTransientError(err) {
+			return ids, err
+		}
+
+		log.Printf("retrying message batch after transient error: %v", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// insert writes a batch of messages atomically.
+func (p *Persister) insert(batch []persistRequest) ([]int64, error) {
+	messages := make([]Message, len(batch))
+	for i, request := range batch {
+		messages[i] = request.message
+	}
+
+	return p.store.insertMessages(messages)
+}
+
+// isTransientError reports whether an operation that failed with err may
+// succeed when retried. CockroachDB asks clients to retry transactions that
+// hit serialization conflicts with SQLSTATE 40001, which are known not to
+// have committed. A lost connection is not retried: the commit may have gone
+// through before it broke, and a retry would insert the batch twice.
+func isTransientError(err error) bool {
+	var pqErr *pq.Error
+
+	return errors.As(err, &pqErr) && pqErr.Code == "40001"
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&pq.Error{Code: "40001"}, true},
+		{fmt.Errorf("committing: %w", &pq.Error{Code: "40001"}), true},
+		{&pq.Error{Code: "23505"}, false},
+		{&pq.Error{Code: "08006"}, false},
+		{errors.New("driver: bad connection"), false},
+	}
+
+	for _, test := range tests {
+		if got := isTransientError(test.err); got != test.want {
+			t.Errorf("isTransientError(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+// failingStore is a memory store whose inserts fail with the given errors
+// before they go through.
+type failingStore struct {
+	*MemoryStore
+	errs    []error
+	inserts int
+}
+
+func (s *failingStore) insertMessages(messages []Message) ([]int64, error) {
+	s.inserts++
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		return nil, err
+	}
+
+	return s.MemoryStore.insertMessages(messages)
+}
+
+func TestPersisterRetries(t *testing.T) {
+	defer func(retries int) { config.Limits.MaxRetries = retries }(config.Limits.MaxRetries)
+	config.Limits.MaxRetries = 2
+
+	conflict := &pq.Error{Code: "40001"}
+
+	tests := []struct {
+		name    string
+		errs    []error
+		inserts int
+		wantErr bool
+	}{
+		{"conflicts", []error{conflict, conflict}, 3, false},
+		{"too many conflicts", []error{conflict, conflict, conflict}, 3, true},
+		{"unique violation", []error{&pq.Error{Code: "23505"}}, 1, true},
+		{"lost connection", []error{errors.New("driver: bad connection")}, 1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &failingStore{MemoryStore: newMemoryStore(), errs: test.errs}
+			f := newStoreFixture(t, store)
+			persister := newPersister(store)
+			go persister.run()
+			defer persister.close()
+
+			done := make(chan persistResult, 1)
+			persister.enqueue(persistRequest{message: Message{Sender: strconv.Itoa(f.alice.ID), RoomID: strconv.Itoa(f.room.ID), Message: "hi"}, done: done})
+			result := <-done
+
+			if (result.err != nil) != test.wantErr {
+				t.Errorf("err = %v, want error %v", result.err, test.wantErr)
+			}
+			if result.err == nil && result.request.message.ID == 0 {
+				t.Error("the persisted message has no ID")
+			}
+			if store.inserts != test.inserts {
+				t.Errorf("inserts = %v, want %v", store.inserts, test.inserts)
+			}
+		})
+	}
+}
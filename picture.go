@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Sizes of the square pictures made of an uploaded profile or room picture,
+// in pixels.
+var pictureSizes = []int{64, 128, 256}
+
+// Size served when the request does not ask for one.
+const defaultPictureSize = 128
+
+// errInvalidPicture is returned for uploads that are not JPEG, PNG or GIF
+// images or are too large to decode.
+var errInvalidPicture = errors.New("picture must be a JPEG, PNG or GIF image")
+
+// savePicture crops an uploaded image to a square, scales it to every
+// picture size and stores the results named after the hash of the upload.
+// It returns the URL path of the picture.
+func savePicture(pictures *LocalBlobStore, data []byte) (string, error) {
+	if !isImage(http.DetectContentType(data)) {
+		return "", errInvalidPicture
+	}
+
+	img, format, err := decodeImage(data)
+	if err != nil {
+		return "", errInvalidPicture
+	}
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	extension := "png"
+	if format == "jpeg" {
+		extension = "jpg"
+	}
+
+	// The largest square in the middle of the image.
+	bounds := img.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	square := image.Rect(0, 0, side, side).Add(bounds.Min).Add(image.Pt((bounds.Dx()-side)/2, (bounds.Dy()-side)/2))
+	source := rgbaImage(img, square)
+
+	for _, size := range pictureSizes {
+		key := pictureKey(hash, size, extension)
+
+		// The same upload gives the same files.
+		if _, err := os.Stat(pictures.path(key)); err == nil {
+			continue
+		}
+
+		encoded, contentType, err := encodeImage(scaleRGBA(source, size, size), format)
+		if err != nil {
+			return "", err
+		}
+
+		if err := pictures.put(key, encoded, contentType); err != nil {
+			return "", err
+		}
+	}
+
+	return "/pictures/" + hash + "." + extension, nil
+}
+
+func pictureKey(hash string, size int, extension string) string {
+	return fmt.Sprintf("%s-%d.%s", hash, size, extension)
+}
+
+// readPicture reads and saves the picture uploaded in the request, writing
+// an error response and returning false if that fails.
+func readPicture(pictures *LocalBlobStore, w http.ResponseWriter, r *http.Request) (string, bool) {
+	_, data, ok := readUpload(w, r, config.Pictures.MaxSizeBytes)
+	if !ok {
+		return "", false
+	}
+
+	path, err := savePicture(pictures, data)
+	if err == errInvalidPicture {
+		writeJSONError(w, 400, "Picture must be a JPEG, PNG or GIF image")
+		return "", false
+	}
+	if err != nil {
+		log.Printf("error saving picture: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return "", false
+	}
+
+	return path, true
+}
+
+// serveUserPicture sets the profile picture of the authenticated user from
+// the file field of a multipart body.
+func serveUserPicture(store Store, pictures *LocalBlobStore, w http.ResponseWriter, r *http.Request, userID int) {
+	log.Println(r.URL)
+
+	user, ok := userFromPath(store, w, r, userID)
+	if !ok {
+		return
+	}
+
+	path, ok := readPicture(pictures, w, r)
+	if !ok {
+		return
+	}
+
+	user.ProfilePicture = path
+	if err := store.updateUser(user); err != nil {
+		log.Printf("error updating user: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	writeJSON(w, 200, user)
+}
+
+// serveRoomPicture sets the picture of a room from the file field of a
+// multipart body. Admins only.
+func serveRoomPicture(store Store, pictures *LocalBlobStore, w http.ResponseWriter, r *http.Request, userID int) {
+	log.Println(r.URL)
+
+	room, ok := roomFromPath(store, w, r)
+	if !ok {
+		return
+	}
+
+	if !requireRoomAdmin(store, w, room.ID, userID, "Only room admins can modify the room") {
+		return
+	}
+
+	path, ok := readPicture(pictures, w, r)
+	if !ok {
+		return
+	}
+
+	room.Picture = path
+	if err := store.updateRoom(room); err != nil {
+		log.Printf("error updating room: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	writeJSON(w, 200, room)
+}
+
+// servePicture serves a picture in the size given with ?size=. Pictures
+// never change, so they can be cached forever.
+func servePicture(pictures *LocalBlobStore, w http.ResponseWriter, r *http.Request) {
+	hash, extension, _ := strings.Cut(r.PathValue("name"), ".")
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha256.Size || (extension != "jpg" && extension != "png") {
+		writeJSONError(w, 404, "Picture not found")
+		return
+	}
+
+	size := defaultPictureSize
+	if value := r.URL.Query().Get("size"); value != "" {
+		size, _ = strconv.Atoi(value)
+		if !validPictureSize(size) {
+			writeJSONError(w, 400, fmt.Sprintf("Invalid size, expected one of %v", pictureSizes))
+			return
+		}
+	}
+
+	path := pictures.path(pictureKey(hash, size, extension))
+	if _, err := os.Stat(path); err != nil {
+		writeJSONError(w, 404, "Picture not found")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, hash, size))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, path)
+}
+
+func validPictureSize(size int) bool {
+	for _, pictureSize := range pictureSizes {
+		if size == pictureSize {
+			return true
+		}
+	}
+
+	return false
+}
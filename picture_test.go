@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// A 200x100 picture with red and blue stripes at the sides of a green
+// square.
+func stripedPNG(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for x := 0; x < 200; x++ {
+		c := color.RGBA{G: 255, A: 255}
+		if x < 50 {
+			c = color.RGBA{R: 255, A: 255}
+		} else if x >= 150 {
+			c = color.RGBA{B: 255, A: 255}
+		}
+		for y := 0; y < 100; y++ {
+			img.Set(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestSavePicture(t *testing.T) {
+	pictures, err := newLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := savePicture(pictures, stripedPNG(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(path, "/pictures/") || !strings.HasSuffix(path, ".png") {
+		t.Fatalf("path = %q", path)
+	}
+	hash := strings.TrimSuffix(strings.TrimPrefix(path, "/pictures/"), ".png")
+
+	for _, size := range pictureSizes {
+		file, err := os.Open(pictures.path(pictureKey(hash, size, "png")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bounds := img.Bounds(); bounds.Dx() != size || bounds.Dy() != size {
+			t.Errorf("picture of size %d is %v", size, bounds)
+		}
+
+		// Only the green middle of the picture is kept.
+		for _, p := range []image.Point{{0, 0}, {size - 1, 0}, {size / 2, size / 2}, {0, size - 1}, {size - 1, size - 1}} {
+			if r, g, b, _ := img.At(p.X, p.Y).RGBA(); r > 0x1000 || b > 0x1000 || g < 0xf000 {
+				t.Errorf("pixel %v of size %d = %v, want green", p, size, img.At(p.X, p.Y))
+			}
+		}
+	}
+
+	again, err := savePicture(pictures, stripedPNG(t))
+	if err != nil || again != path {
+		t.Errorf("saving the picture again = %q, %v, want %q", again, err, path)
+	}
+
+	if _, err := savePicture(pictures, []byte("not a picture")); err != errInvalidPicture {
+		t.Errorf("saving text: err = %v, want errInvalidPicture", err)
+	}
+}
+
+func TestServePicture(t *testing.T) {
+	pictures, err := newLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := savePicture(pictures, stripedPNG(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := strings.TrimPrefix(path, "/pictures/")
+	missing := strings.Repeat("0", 64) + ".png"
+
+	tests := []struct {
+		name string
+		size string
+		code int
+	}{
+		{name, "", 200},
+		{name, "?size=256", 200},
+		{name, "?size=100", 400},
+		{missing, "", 404},
+		{"../secret.png", "", 404},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/pictures/x"+test.size, nil)
+		r.SetPathValue("name", test.name)
+		w := httptest.NewRecorder()
+		servePicture(pictures, w, r)
+
+		if w.Code != test.code {
+			t.Errorf("%s%s: code = %v, want %v", test.name, test.size, w.Code, test.code)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Presence statuses of a user.
+const (
+	// At least one device is connected and active.
+	statusOnline = "online"
+
+	// Every connected device is idle or set itself away.
+	statusAway = "away"
+
+	// No device is connected.
+	statusOffline = "offline"
+)
+
+// How often the hub looks for devices that have become idle.
+const presenceCheckPeriod = 15 * time.Second
+
+// Maximum number of users in one presence snapshot request.
+const maxPresenceUsers = 100
+
+// Presence is the status of a user. Clients only send the status of their
+// own device.
+type Presence struct {
+	UserID   string `json:"user_id,omitempty"`
+	Status   string `json:"status"`
+	LastSeen string `json:"last_seen,omitempty"`
+}
+
+// presenceQuery asks the hub for the current status of users.
+type presenceQuery struct {
+	userIDs []int
+	reply   chan map[int]string
+}
+
+// loadedContacts is the result of loading the contacts of a user outside
+// the hub.
+type loadedContacts struct {
+	userID   int
+	contacts map[int]bool
+
+	// contactsVersion of the hub when the load started.
+	version int
+
+	err error
+}
+
+// markActive records activity on a device, bringing it back from away.
+func (h *Hub) markActive(client *Client) {
+	client.away = false
+	client.lastActive = time.Now()
+	h.updatePresence(client.userID)
+}
+
+// isActive reports whether a device counts as online.
+func (h *Hub) isActive(client *Client) bool {
+	return !client.away && time.Since(client.lastActive) < time.Duration(config.Presence.AwayAfterSeconds)*time.Second
+}
+
+// userStatus combines the statuses of every device of a user.
+func (h *Hub) userStatus(userID int) string {
+	devices := h.users[userID]
+	if len(devices) == 0 {
+		return statusOffline
+	}
+
+	for client := range devices {
+		if h.isActive(client) {
+			return statusOnline
+		}
+	}
+
+	return statusAway
+}
+
+// updatePresence announces the status of a user to their contacts if it has
+// changed. last_seen is saved when the last device disconnects.
+func (h *Hub) updatePresence(userID int) {
+	previous, ok := h.statuses[userID]
+	if !ok {
+		previous = statusOffline
+	}
+
+	status := h.userStatus(userID)
+	if status == previous {
+		return
+	}
+
+	presence := Presence{UserID: strconv.Itoa(userID), Status: status}
+	if status == statusOffline {
+		delete(h.statuses, userID)
+
+		lastSeen := time.Now()
+		h.saveLastSeen(userID, lastSeen)
+		presence.LastSeen = lastSeen.Format(time.RFC3339Nano)
+	} else {
+		h.statuses[userID] = status
+	}
+
+	// Everyone is disconnected on shutdown, nobody is left to tell.
+	if h.draining {
+		return
+	}
+
+	h.broadcastPresence(userID, presence)
+}
+
+// saveLastSeen writes the last_seen of a user outside the hub. The store
+// keeps the later time if two writes overtake each other.
+func (h *Hub) saveLastSeen(userID int, lastSeen time.Time) {
+	h.lastSeenWrites.Add(1)
+	go func() {
+		defer h.lastSeenWrites.Done()
+
+		// The user may have been deleted.
+		if err := h.store.setLastSeen(userID, lastSeen); err != nil && err != errNotFound {
+			log.Printf("error updating last seen: %v", err)
+		}
+	}()
+}
+
+// broadcastPresence sends a presence change to the contacts of the user and
+// to the user's own devices. If the contacts are not cached yet, they are
+// loaded outside the hub and the latest change is sent once they arrive.
+func (h *Hub) broadcastPresence(userID int, presence Presence) {
+	contacts, ok := h.contacts[userID]
+	if !ok {
+		if _, loading := h.pendingPresence[userID]; !loading {
+			h.loadContacts(userID)
+		}
+		h.pendingPresence[userID] = presence
+		return
+	}
+
+	h.sendPresence(userID, presence, contacts)
+}
+
+// sendPresence sends a presence change to the given contacts and the user's
+// own devices. The contacts of users who have gone offline are not kept.
+func (h *Hub) sendPresence(userID int, presence Presence, contacts map[int]bool) {
+	if _, ok := h.users[userID]; !ok {
+		delete(h.contacts, userID)
+	}
+
+	data := h.encode(Envelope{Type: typePresence, Presence: &presence})
+	if data == nil {
+		return
+	}
+
+	h.sendToUser(userID, data)
+	for contactID := range contacts {
+		h.sendToUser(contactID, data)
+	}
+}
+
+// loadContacts loads the contacts of a user outside the hub and hands them
+// to contactsReady.
+func (h *Hub) loadContacts(userID int) {
+	version := h.contactsVersion
+
+	go func() {
+		contacts, err := h.members.contacts(userID)
+		h.contactsLoaded <- loadedContacts{userID: userID, contacts: contacts, version: version, err: err}
+	}()
+}
+
+// contactsReady caches the loaded contacts of a user and sends them the
+// pending presence change. Contacts loaded before a membership change are
+// loaded again, and failed loads are retried later.
+func (h *Hub) contactsReady(loaded loadedContacts) {
+	presence, ok := h.pendingPresence[loaded.userID]
+	if !ok {
+		return
+	}
+
+	if loaded.err != nil {
+		log.Printf("error getting user contacts: %v", loaded.err)
+		time.AfterFunc(membersRetryDelay, func() { h.loadContacts(loaded.userID) })
+		return
+	}
+
+	if loaded.version != h.contactsVersion {
+		h.loadContacts(loaded.userID)
+		return
+	}
+
+	delete(h.pendingPresence, loaded.userID)
+	h.contacts[loaded.userID] = loaded.contacts
+	h.sendPresence(loaded.userID, presence, loaded.contacts)
+}
+
+// dropContacts forgets every cached contact after room memberships have
+// changed, since the members of a room are the contacts of each other.
+func (h *Hub) dropContacts() {
+	h.contacts = make(map[int]map[int]bool)
+	h.contactsVersion++
+}
+
+// addContacts records a direct conversation between two users in their
+// cached contacts. Loads in flight may have missed it, so they are redone.
+func (h *Hub) addContacts(message Message) {
+	if message.RoomID != "" {
+		return
+	}
+
+	sender, _ := strconv.Atoi(message.Sender)
+	receiver, _ := strconv.Atoi(message.Receiver)
+
+	if contacts, ok := h.contacts[sender]; ok {
+		contacts[receiver] = true
+	}
+	if contacts, ok := h.contacts[receiver]; ok {
+		contacts[sender] = true
+	}
+
+	_, senderLoading := h.pendingPresence[sender]
+	_, receiverLoading := h.pendingPresence[receiver]
+	if senderLoading || receiverLoading {
+		h.contactsVersion++
+	}
+}
+
+// checkIdle turns users whose devices have all gone idle away.
+func (h *Hub) checkIdle() {
+	for userID := range h.users {
+		h.updatePresence(userID)
+	}
+}
+
+// snapshot returns the current status of the given users.
+func (h *Hub) snapshot(userIDs []int) map[int]string {
+	statuses := make(map[int]string)
+	for _, userID := range userIDs {
+		status, ok := h.statuses[userID]
+		if !ok {
+			status = statusOffline
+		}
+		statuses[userID] = status
+	}
+
+	return statuses
+}
+
+// servePresence returns the status and last_seen of the users listed in
+// user_ids. Only the user themselves and their contacts are included.
+func servePresence(hub *Hub, w http.ResponseWriter, r *http.Request, userID int) {
+	log.Println(r.URL)
+
+	store := hub.store
+
+	var userIDs []int
+	for _, field := range strings.Split(r.URL.Query().Get("user_ids"), ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			writeJSONError(w, 400, "user_ids must be a comma separated list of user IDs")
+			return
+		}
+		userIDs = append(userIDs, id)
+	}
+
+	if len(userIDs) > maxPresenceUsers {
+		writeJSONError(w, 400, "Too many user_ids, at most "+strconv.Itoa(maxPresenceUsers)+" allowed")
+		return
+	}
+
+	contacts, err := hub.members.contacts(userID)
+	if err != nil {
+		log.Printf("error getting user contacts: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+	contacts[userID] = true
+
+	var visible []int
+	for _, id := range userIDs {
+		if contacts[id] {
+			visible = append(visible, id)
+		}
+	}
+
+	query := presenceQuery{userIDs: visible, reply: make(chan map[int]string, 1)}
+	hub.presenceQueries <- query
+	statuses := <-query.reply
+
+	presence := []Presence{}
+	for _, id := range visible {
+		user, err := store.getUser(id)
+		if err == errNotFound {
+			continue
+		}
+		if err != nil {
+			log.Printf("error getting user: %v", err)
+			writeJSONError(w, 500, "Internal server error")
+			return
+		}
+
+		presence = append(presence, Presence{UserID: strconv.Itoa(id), Status: statuses[id], LastSeen: user.LastSeen})
+	}
+
+	writeJSON(w, 200, map[string][]Presence{"presence": presence})
+}
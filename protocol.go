@@ -0,0 +1,304 @@
+package main
+
+import (
+	"strconv"
+	"unicode/utf8"
+)
+
+// Version of the websocket protocol. Every envelope carries it in the v field
+// and clients speaking another version are rejected.
+const protocolVersion = 1
+
+// Maximum length of a client generated message ID.
+const maxClientMsgIDLength = 64
+
+// Envelope types of the websocket protocol.
+const (
+	// Client asks to receive the messages of a room.
+	typeSubscribe = "subscribe"
+
+	// Client stops receiving the messages of a room. Also sent by the server
+	// when the user is removed from a room.
+	typeUnsubscribe = "unsubscribe"
+
+	// A chat message, either direct or to a room.
+	typeMessage = "message"
+
+	// Server confirms that a request was handled.
+	typeAck = "ack"
+
+	// Server rejects a request.
+	typeError = "error"
+
+	// Server is shutting down and closes the connection next.
+	typeGoingAway = "going_away"
+
+	// Client sets its device online or away. Sent by the server when the
+	// status of a contact changes.
+	typePresence = "presence"
+
+	// User starts or stops typing in a room or to a DM peer. Relayed by the
+	// server, never saved.
+	typeTypingStart = "typing_start"
+	typeTypingStop  = "typing_stop"
+
+	// Client marks a conversation read up to a message. The server sends a
+	// receipt to the other participants.
+	typeMarkRead = "mark_read"
+	typeReceipt  = "receipt"
+
+	// Client edits or deletes a message given by its id. The server sends
+	// the changed message in an update frame to everyone who received it.
+	typeEdit   = "edit"
+	typeDelete = "delete"
+	typeUpdate = "update"
+
+	// User adds or removes an emoji reaction to a message. Relayed with the
+	// user to everyone who received the message.
+	typeReactionAdd    = "reaction_add"
+	typeReactionRemove = "reaction_remove"
+
+	// Server tells the participants of a room thread about a new reply.
+	typeThreadReply = "thread_reply"
+
+	// Client tells the last messages it has seen after reconnecting. The
+	// server replays the missed ones before live delivery.
+	typeResume = "resume"
+)
+
+// Error codes of error frames.
+const (
+	errorBadRequest         = "bad_request"
+	errorUnsupportedVersion = "unsupported_version"
+	errorUnknownType        = "unknown_type"
+	errorInvalidMessage     = "invalid_message"
+	errorForbidden          = "forbidden"
+	errorBusy               = "busy"
+	errorRateLimited        = "rate_limited"
+	errorInternal           = "internal"
+)
+
+// Envelope is a single frame sent over the websocket in either direction.
+type Envelope struct {
+	V    int    `json:"v"`
+	Type string `json:"type"`
+
+	// ID the client gave to a request. Echoed back in its ack or error.
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+
+	// Room of a subscribe or unsubscribe request.
+	RoomID string `json:"room_id,omitempty"`
+
+	// Chat message of a message frame.
+	Message *Message `json:"message,omitempty"`
+
+	// Status of a presence frame.
+	Presence *Presence `json:"presence,omitempty"`
+
+	// Conversation of a typing_start or typing_stop frame.
+	Typing *Typing `json:"typing,omitempty"`
+
+	// Read marker of a mark_read or receipt frame.
+	Read *ReadMarker `json:"read,omitempty"`
+
+	// Reaction of a reaction_add or reaction_remove frame.
+	Reaction *Reaction `json:"reaction,omitempty"`
+
+	// Conversations of a resume frame and its ack.
+	Resume *Resume `json:"resume,omitempty"`
+
+	// Type of the request an ack or error refers to.
+	Ref string `json:"ref,omitempty"`
+
+	// Chatlog ID and server timestamp of an acknowledged message.
+	ID        int64 `json:"id,omitempty"`
+	Timestamp int64 `json:"timestamp,omitempty"`
+
+	// Reason of an error frame.
+	Error *ProtocolError `json:"error,omitempty"`
+
+	// Seconds a client should wait before reconnecting after going_away.
+	ReconnectAfter int `json:"reconnect_after,omitempty"`
+}
+
+// ProtocolError describes why a request was rejected.
+type ProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// inbound is an envelope received from a client. problem is set when the
+// frame could not be decoded or prepare refused it.
+type inbound struct {
+	client   *Client
+	envelope Envelope
+	problem  *ProtocolError
+
+	// Results of prepare: the new, changed or reacted to message, whether a
+	// reaction changed anything, the saved read marker, the users to tell
+	// about a reply to a room thread and the replay of a resume.
+	message          Message
+	changed          bool
+	receipt          readReceipt
+	threadRecipients []int
+	resume           resumeResult
+}
+
+func protocolError(code string, message string) *ProtocolError {
+	return &ProtocolError{Code: code, Message: message}
+}
+
+// validateEnvelope checks an envelope received from a client before the hub
+// acts on it.
+func validateEnvelope(envelope Envelope) *ProtocolError {
+	if envelope.V != protocolVersion {
+		return protocolError(errorUnsupportedVersion, "Unsupported protocol version, expected "+strconv.Itoa(protocolVersion))
+	}
+
+	if len(envelope.ClientMsgID) > maxClientMsgIDLength {
+		return protocolError(errorBadRequest, "client_msg_id is too long")
+	}
+
+	switch envelope.Type {
+	case typeSubscribe, typeUnsubscribe:
+		if _, err := strconv.Atoi(envelope.RoomID); err != nil {
+			return protocolError(errorBadRequest, "Invalid room_id")
+		}
+	case typeMessage:
+		if envelope.ClientMsgID == "" {
+			return protocolError(errorBadRequest, "Missing client_msg_id")
+		}
+
+		return validateMessage(envelope.Message)
+	case typePresence:
+		if envelope.Presence == nil || (envelope.Presence.Status != statusOnline && envelope.Presence.Status != statusAway) {
+			return protocolError(errorBadRequest, "Presence status must be online or away")
+		}
+	case typeTypingStart, typeTypingStop:
+		return validateTyping(envelope.Typing)
+	case typeMarkRead:
+		return validateReadMarker(envelope.Read)
+	case typeEdit, typeDelete:
+		return validateModify(envelope)
+	case typeReactionAdd, typeReactionRemove:
+		if envelope.Reaction == nil || envelope.Reaction.MessageID < 1 {
+			return protocolError(errorBadRequest, "Missing reaction message_id")
+		}
+
+		if !isEmoji(envelope.Reaction.Emoji) {
+			return protocolError(errorBadRequest, "Reaction must be an emoji")
+		}
+	case typeResume:
+		return validateResume(envelope.Resume)
+	default:
+		return protocolError(errorUnknownType, "Unknown envelope type")
+	}
+
+	return nil
+}
+
+// validateMessage checks the contents of a chat message sent by a client.
+func validateMessage(message *Message) *ProtocolError {
+	if message == nil {
+		return protocolError(errorInvalidMessage, "Missing message")
+	}
+
+	if len(message.Attachments) > maxAttachments {
+		return protocolError(errorInvalidMessage, "Too many attachments")
+	}
+
+	// The text can be left out when sending files.
+	if message.Message != "" || len(message.Attachments) == 0 {
+		if problem := validateText(message.Message); problem != nil {
+			return problem
+		}
+	}
+
+	if message.ReplyTo < 0 {
+		return protocolError(errorInvalidMessage, "Invalid reply_to")
+	}
+
+	if message.RoomID != "" {
+		if _, err := strconv.Atoi(message.RoomID); err != nil {
+			return protocolError(errorInvalidMessage, "Invalid room_id")
+		}
+		if message.Receiver != "" {
+			return protocolError(errorInvalidMessage, "Message needs either a room_id or a receiver")
+		}
+		return nil
+	}
+
+	if _, err := strconv.Atoi(message.Receiver); err != nil {
+		return protocolError(errorInvalidMessage, "Invalid receiver")
+	}
+
+	return nil
+}
+
+// validateTyping checks that a typing frame names either a room or a DM peer.
+func validateTyping(typing *Typing) *ProtocolError {
+	if typing == nil {
+		return protocolError(errorBadRequest, "Missing typing")
+	}
+
+	if typing.RoomID != "" {
+		if _, err := strconv.Atoi(typing.RoomID); err != nil || typing.Receiver != "" {
+			return protocolError(errorBadRequest, "Typing needs either a valid room_id or receiver")
+		}
+		return nil
+	}
+
+	if _, err := strconv.Atoi(typing.Receiver); err != nil {
+		return protocolError(errorBadRequest, "Typing needs either a valid room_id or receiver")
+	}
+
+	return nil
+}
+
+// validateReadMarker checks that a read marker names either a room or a DM
+// peer and a message.
+func validateReadMarker(marker *ReadMarker) *ProtocolError {
+	if marker == nil {
+		return protocolError(errorBadRequest, "Missing read")
+	}
+
+	if marker.LastReadID < 1 {
+		return protocolError(errorBadRequest, "Invalid last_read_id")
+	}
+
+	if marker.RoomID != "" {
+		if _, err := strconv.Atoi(marker.RoomID); err != nil || marker.Peer != "" {
+			return protocolError(errorBadRequest, "Read marker needs either a valid room_id or peer")
+		}
+		return nil
+	}
+
+	if _, err := strconv.Atoi(marker.Peer); err != nil {
+		return protocolError(errorBadRequest, "Read marker needs either a valid room_id or peer")
+	}
+
+	return nil
+}
+
+// validateText checks the text of a new or edited chat message.
+func validateText(text string) *ProtocolError {
+	if text == "" || !utf8.ValidString(text) {
+		return protocolError(errorInvalidMessage, "Message must be non-empty UTF-8 text")
+	}
+
+	return nil
+}
+
+// validateModify checks an edit or delete frame. It names the message by its
+// chatlog ID and an edit carries the new text.
+func validateModify(envelope Envelope) *ProtocolError {
+	if envelope.Message == nil || envelope.Message.ID < 1 {
+		return protocolError(errorInvalidMessage, "Missing message id")
+	}
+
+	if envelope.Type == typeEdit {
+		return validateText(envelope.Message.Message)
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Maximum length of a reaction in bytes. Emoji sequences with skin tones and
+// joiners take several code points.
+const maxEmojiLength = 32
+
+// Reaction is an emoji a user reacted to a message with. The server adds the
+// user when delivering it.
+type Reaction struct {
+	MessageID int64  `json:"message_id"`
+	UserID    string `json:"user_id,omitempty"`
+	Emoji     string `json:"emoji"`
+}
+
+// ReactionCount is the number of users who reacted to a message with an
+// emoji, and whether the requesting user is one of them.
+type ReactionCount struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted"`
+}
+
+// isEmoji reports whether text consists of emoji: symbols together with the
+// modifiers, variation selectors and joiners used in emoji sequences.
+func isEmoji(text string) bool {
+	if text == "" || len(text) > maxEmojiLength || !utf8.ValidString(text) {
+		return false
+	}
+
+	symbol := false
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.So, r):
+			symbol = true
+		case unicode.In(r, unicode.Sk, unicode.Mn, unicode.Me, unicode.Cf):
+		default:
+			return false
+		}
+	}
+
+	return symbol
+}
+
+// countReactions aggregates the reactions of messages per emoji for userID,
+// keeping the emoji in the order they were first used.
+func countReactions(reactions []Reaction, userID int) map[int64][]ReactionCount {
+	user := strconv.Itoa(userID)
+	counts := make(map[int64][]ReactionCount)
+
+	for _, reaction := range reactions {
+		messageCounts := counts[reaction.MessageID]
+
+		i := 0
+		for i < len(messageCounts) && messageCounts[i].Emoji != reaction.Emoji {
+			i++
+		}
+		if i == len(messageCounts) {
+			messageCounts = append(messageCounts, ReactionCount{Emoji: reaction.Emoji})
+		}
+
+		messageCounts[i].Count++
+		if reaction.UserID == user {
+			messageCounts[i].Reacted = true
+		}
+		counts[reaction.MessageID] = messageCounts
+	}
+
+	return counts
+}
+
+// react adds or removes a reaction of userID and returns the message
+// reacted to and whether anything changed. Runs in the readPump, see
+// prepare.
+func (h *Hub) react(userID int, reaction Reaction, frameType string) (Message, bool, *ProtocolError) {
+	message, err := h.store.getMessage(reaction.MessageID)
+	if err == errNotFound {
+		return message, false, protocolError(errorInvalidMessage, "Message not found")
+	}
+	if err != nil {
+		log.Printf("error getting message: %v", err)
+		return message, false, protocolError(errorInternal, "Reaction could not be saved")
+	}
+
+	visible, err := h.members.canRead(userID, message)
+	if err != nil {
+		log.Printf("error getting room members: %v", err)
+		return message, false, protocolError(errorInternal, "Reaction could not be saved")
+	}
+
+	if !visible {
+		return message, false, protocolError(errorForbidden, "Not a participant of the conversation")
+	}
+
+	if message.DeletedAt != 0 {
+		return message, false, protocolError(errorInvalidMessage, "Message has been deleted")
+	}
+
+	var changed bool
+	if frameType == typeReactionAdd {
+		changed, err = h.store.addReaction(reaction.MessageID, userID, reaction.Emoji)
+	} else {
+		changed, err = h.store.removeReaction(reaction.MessageID, userID, reaction.Emoji)
+	}
+	if err != nil {
+		log.Printf("error saving reaction: %v", err)
+		return message, false, protocolError(errorInternal, "Reaction could not be saved")
+	}
+
+	return message, changed, nil
+}
+
+// handleReaction acknowledges a saved reaction and sends the change to
+// everyone who received the message.
+func (h *Hub) handleReaction(client *Client, in inbound) {
+	reaction := *in.envelope.Reaction
+	reaction.UserID = strconv.Itoa(client.userID)
+
+	h.ack(client, in.envelope, Envelope{Reaction: &reaction})
+	h.announce(in)
+}
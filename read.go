@@ -0,0 +1,194 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// ReadMarker is the last message a user has read in a room or in a direct
+// conversation with peer.
+type ReadMarker struct {
+	UserID     string `json:"user_id,omitempty"`
+	RoomID     string `json:"room_id,omitempty"`
+	Peer       string `json:"peer,omitempty"`
+	LastReadID int64  `json:"last_read_id"`
+}
+
+// readReceipt is a read marker that has been saved and is announced to the
+// other participants. Exactly one of roomID and peerID is set.
+type readReceipt struct {
+	userID     int
+	roomID     int
+	peerID     int
+	lastReadID int64
+}
+
+func (receipt readReceipt) marker() ReadMarker {
+	marker := ReadMarker{UserID: strconv.Itoa(receipt.userID), LastReadID: receipt.lastReadID}
+	if receipt.roomID != 0 {
+		marker.RoomID = strconv.Itoa(receipt.roomID)
+	} else {
+		marker.Peer = strconv.Itoa(receipt.peerID)
+	}
+
+	return marker
+}
+
+// conversation is a room, or a direct conversation with peerID as seen by
+// one user.
+type conversation struct {
+	roomID int
+	peerID int
+}
+
+// conversationOf returns the conversation a message belongs to for userID.
+func conversationOf(userID int, message Message) conversation {
+	if message.RoomID != "" {
+		roomID, _ := strconv.Atoi(message.RoomID)
+		return conversation{roomID: roomID}
+	}
+
+	peer := message.Sender
+	if peer == strconv.Itoa(userID) {
+		peer = message.Receiver
+	}
+	peerID, _ := strconv.Atoi(peer)
+
+	return conversation{peerID: peerID}
+}
+
+// conversationState is the unread count and the latest message of a
+// conversation.
+type conversationState struct {
+	unread int
+	latest *Message
+}
+
+// saveReadMarker saves the read marker sent by userID in a mark_read frame.
+// Runs in the readPump, see prepare.
+func (h *Hub) saveReadMarker(userID int, marker ReadMarker) (readReceipt, *ProtocolError) {
+	receipt := readReceipt{userID: userID}
+	if marker.RoomID != "" {
+		receipt.roomID, _ = strconv.Atoi(marker.RoomID)
+		if problem := h.requireMember(receipt.roomID, userID); problem != nil {
+			return receipt, problem
+		}
+	} else {
+		receipt.peerID, _ = strconv.Atoi(marker.Peer)
+	}
+
+	lastReadID, err := h.store.markRead(receipt.userID, receipt.roomID, receipt.peerID, marker.LastReadID)
+	if err == errNotFound {
+		return receipt, protocolError(errorBadRequest, "Message is not in the conversation")
+	}
+	if err != nil {
+		log.Printf("error saving read marker: %v", err)
+		return receipt, protocolError(errorInternal, "Read marker could not be saved")
+	}
+
+	receipt.lastReadID = lastReadID
+
+	return receipt, nil
+}
+
+// handleMarkRead acknowledges a saved read marker and announces it.
+func (h *Hub) handleMarkRead(client *Client, in inbound) {
+	marker := in.receipt.marker()
+	h.ack(client, in.envelope, Envelope{Read: &marker})
+	h.announce(in)
+}
+
+// broadcastReceipt sends a receipt to the user's devices and to the other
+// participants of the conversation: the subscribers of the room or the DM
+// peer.
+func (h *Hub) broadcastReceipt(receipt readReceipt) {
+	marker := receipt.marker()
+	data := h.encode(Envelope{Type: typeReceipt, Read: &marker})
+	if data == nil {
+		return
+	}
+
+	h.sendToUser(receipt.userID, data)
+
+	if receipt.roomID == 0 {
+		if receipt.peerID != receipt.userID {
+			h.sendToUser(receipt.peerID, data)
+		}
+		return
+	}
+
+	for client := range h.rooms[receipt.roomID] {
+		if client.userID != receipt.userID {
+			h.deliver(client, data)
+		}
+	}
+}
+
+// serveMarkRead saves a read marker given as {"last_read_id": ...} and
+// announces it like a mark_read frame would.
+func serveMarkRead(hub *Hub, store Store, w http.ResponseWriter, r *http.Request, receipt readReceipt) {
+	var body ReadMarker
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	if body.LastReadID < 1 {
+		writeJSONError(w, 400, "Invalid last_read_id")
+		return
+	}
+
+	lastReadID, err := store.markRead(receipt.userID, receipt.roomID, receipt.peerID, body.LastReadID)
+	if err == errNotFound {
+		writeJSONError(w, 400, "Message is not in the conversation")
+		return
+	}
+	if err != nil {
+		log.Printf("error saving read marker: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	receipt.lastReadID = lastReadID
+	hub.receipts <- receipt
+
+	writeJSON(w, 200, receipt.marker())
+}
+
+// serveMarkRoomRead sets the read marker of a room. Members only.
+func serveMarkRoomRead(hub *Hub, store Store, w http.ResponseWriter, r *http.Request, userID int) {
+	log.Println(r.URL)
+
+	room, ok := roomFromPath(store, w, r)
+	if !ok {
+		return
+	}
+
+	member, err := isRoomMember(store, room.ID, userID)
+	if err != nil {
+		log.Printf("error checking room membership: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	if !member {
+		writeJSONError(w, 403, "Not a member of the room")
+		return
+	}
+
+	serveMarkRead(hub, store, w, r, readReceipt{userID: userID, roomID: room.ID})
+}
+
+// serveMarkDirectRead sets the read marker of the direct conversation with
+// the peer given in the path.
+func serveMarkDirectRead(hub *Hub, store Store, w http.ResponseWriter, r *http.Request, userID int) {
+	log.Println(r.URL)
+
+	peerID, err := strconv.Atoi(r.PathValue("peer"))
+	if err != nil {
+		writeJSONError(w, 400, "Invalid peer id")
+		return
+	}
+
+	serveMarkRead(hub, store, w, r, readReceipt{userID: userID, peerID: peerID})
+}
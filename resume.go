@@ -0,0 +1,370 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Time a client connected with resume=1 has for sending its resume frame.
+// Until then the messages for it are held back, after it they are delivered
+// as usual.
+const resumeTimeout = 10 * time.Second
+
+// replayLimit is the most missed messages replayed for a resume and
+// heldLimit the most frames held back until then. Together with the ack they
+// fit in the send buffer of the client.
+func replayLimit() int {
+	return config.Limits.SendBufferSize / 2
+}
+
+func heldLimit() int {
+	return config.Limits.SendBufferSize - replayLimit() - 1
+}
+
+// Resume lists the last message a client has seen in each of its
+// conversations, by room ID and by DM peer ID. 0 means none.
+//
+// In the ack, MoreRooms and MoreDMs list the conversations in which more
+// messages were missed than replayed. The older ones can be fetched from
+// history with before set to the given cursor, or without it when the
+// cursor is empty. The cursor is also empty for conversations with frames
+// that could not be held back during the resume.
+type Resume struct {
+	Rooms map[string]int64 `json:"rooms,omitempty"`
+	DMs   map[string]int64 `json:"dms,omitempty"`
+
+	MoreRooms map[string]string `json:"more_rooms,omitempty"`
+	MoreDMs   map[string]string `json:"more_dms,omitempty"`
+}
+
+// heldFrame is a frame held back while its client is resuming.
+type heldFrame struct {
+	frameType string
+	message   Message
+	data      []byte
+}
+
+// validateResume checks the conversations of a resume frame.
+func validateResume(resume *Resume) *ProtocolError {
+	if resume == nil {
+		return protocolError(errorBadRequest, "Missing resume")
+	}
+
+	for _, ids := range []map[string]int64{resume.Rooms, resume.DMs} {
+		for key, id := range ids {
+			if n, err := strconv.Atoi(key); err != nil || n < 1 || id < 0 {
+				return protocolError(errorBadRequest, "Invalid conversation in resume")
+			}
+		}
+	}
+
+	return nil
+}
+
+// deliverRouted delivers a frame about a message to a client. While the
+// client is resuming, the frame is held back until the missed messages have
+// been replayed. Messages the client already got in the replay are skipped.
+func (h *Hub) deliverRouted(client *Client, frameType string, message Message, data []byte) {
+	if client.resuming {
+		if len(client.held) < heldLimit() {
+			client.held = append(client.held, heldFrame{frameType: frameType, message: message, data: data})
+		} else {
+			client.dropped[conversationOf(client.userID, message)] = true
+		}
+		return
+	}
+
+	if frameType == typeMessage {
+		replayed, ok := client.replayed[conversationOf(client.userID, message)]
+		if ok && !replayed.less(cursorOf(message)) {
+			return
+		}
+	}
+
+	h.deliver(client, data)
+}
+
+// startResumeTimer ends the resume of a client that has not sent its resume
+// frame within resumeTimeout.
+func (h *Hub) startResumeTimer(client *Client) {
+	time.AfterFunc(resumeTimeout, func() { h.resumeExpired <- client })
+}
+
+// expireResume delivers the frames held back for a client that did not
+// resume in time.
+func (h *Hub) expireResume(client *Client) {
+	if _, ok := h.clients[client]; ok && client.resuming {
+		h.endResume(client)
+	}
+}
+
+// endResume switches a client to live delivery and delivers the frames held
+// back for it.
+func (h *Hub) endResume(client *Client) {
+	held := client.held
+	client.resuming = false
+	client.held = nil
+	client.dropped = nil
+
+	for _, frame := range held {
+		h.deliverRouted(client, frame.frameType, frame.message, frame.data)
+	}
+}
+
+// resumeSubscription asks the hub to subscribe a resuming client to the
+// rooms of its resume frame before the missed messages are read, so that the
+// room messages sent meanwhile are held back instead of lost. The reply tells
+// whether the client is still resuming.
+type resumeSubscription struct {
+	client *Client
+	rooms  []int
+	reply  chan bool
+}
+
+// subscribeResuming subscribes a resuming client to the rooms of its resume
+// frame that it is not subscribed to yet. Frames for them are held back like
+// the others until the client has resumed.
+func (h *Hub) subscribeResuming(subscription resumeSubscription) {
+	client := subscription.client
+	if _, ok := h.clients[client]; !ok || !client.resuming {
+		subscription.reply <- false
+		return
+	}
+
+	for _, roomID := range subscription.rooms {
+		if !client.rooms[roomID] {
+			h.subscribe(client, roomID)
+			client.resumeRooms = append(client.resumeRooms, roomID)
+		}
+	}
+
+	subscription.reply <- true
+}
+
+// unsubscribeResume undoes the subscriptions made for a resume that failed
+// and drops the frames held back for them.
+func (h *Hub) unsubscribeResume(client *Client) {
+	unsubscribed := make(map[string]bool)
+	for _, roomID := range client.resumeRooms {
+		h.unsubscribe(client, roomID)
+		unsubscribed[strconv.Itoa(roomID)] = true
+	}
+	client.resumeRooms = nil
+
+	held := client.held[:0]
+	for _, frame := range client.held {
+		if !unsubscribed[frame.message.RoomID] {
+			held = append(held, frame)
+		}
+	}
+	client.held = held
+}
+
+// resumeResult is what prepareResume read for a resume frame: the missed
+// messages to replay, the newest message of each conversation and the ack.
+type resumeResult struct {
+	replay   []Message
+	replayed map[conversation]messageCursor
+	ack      Resume
+}
+
+// prepareResume reads the messages a client missed in the conversations it
+// lists, oldest first. At most replayLimit are replayed, the rest is left
+// for the client to fetch from history. The client is subscribed to the
+// rooms before they are read. Runs in the readPump, see prepare.
+func (h *Hub) prepareResume(client *Client, resume Resume) (resumeResult, *ProtocolError) {
+	userID := client.userID
+	result := resumeResult{
+		replayed: make(map[conversation]messageCursor),
+		ack:      Resume{MoreRooms: make(map[string]string), MoreDMs: make(map[string]string)},
+	}
+
+	var conversations []conversation
+	var rooms []int
+	lastSeen := make(map[conversation]int64)
+
+	for key, id := range resume.Rooms {
+		roomID, _ := strconv.Atoi(key)
+		member, err := h.members.isMember(roomID, userID)
+		if err != nil {
+			log.Printf("error getting room members: %v", err)
+			return result, protocolError(errorInternal, "Missed messages could not be read")
+		}
+		if !member {
+			return result, protocolError(errorForbidden, "Not a member of room "+key)
+		}
+
+		conversations = append(conversations, conversation{roomID: roomID})
+		lastSeen[conversation{roomID: roomID}] = id
+		rooms = append(rooms, roomID)
+	}
+
+	for key, id := range resume.DMs {
+		peerID, _ := strconv.Atoi(key)
+		conversations = append(conversations, conversation{peerID: peerID})
+		lastSeen[conversation{peerID: peerID}] = id
+	}
+
+	reply := make(chan bool, 1)
+	h.resumeSubscriptions <- resumeSubscription{client: client, rooms: rooms, reply: reply}
+	if !<-reply {
+		return result, protocolError(errorBadRequest, "Resume is only possible once, on a connection opened with resume=1")
+	}
+
+	sort.Slice(conversations, func(i, j int) bool {
+		if conversations[i].roomID != conversations[j].roomID {
+			return conversations[i].roomID < conversations[j].roomID
+		}
+		return conversations[i].peerID < conversations[j].peerID
+	})
+
+	budget := replayLimit()
+
+	for _, c := range conversations {
+		messages, newest, more, problem := h.missedMessages(userID, c, lastSeen[c], min(budget, config.Limits.MaxHistoryLimit))
+		if problem != nil {
+			return result, problem
+		}
+
+		if newest != nil {
+			result.replayed[c] = *newest
+		}
+
+		if more {
+			cursor := ""
+			if len(messages) > 0 {
+				cursor = cursorOf(messages[0]).encode()
+			}
+
+			if c.roomID != 0 {
+				result.ack.MoreRooms[strconv.Itoa(c.roomID)] = cursor
+			} else {
+				result.ack.MoreDMs[strconv.Itoa(c.peerID)] = cursor
+			}
+		}
+
+		budget -= len(messages)
+		result.replay = append(result.replay, messages...)
+	}
+
+	if err := attachAttachments(h.store, result.replay); err != nil {
+		log.Printf("error reading attachments: %v", err)
+		return result, protocolError(errorInternal, "Missed messages could not be read")
+	}
+
+	sort.Slice(result.replay, func(i, j int) bool {
+		return cursorOf(result.replay[i]).less(cursorOf(result.replay[j]))
+	})
+
+	return result, nil
+}
+
+// handleResume replays the missed messages prepareResume read and then
+// switches the client to live delivery.
+func (h *Hub) handleResume(client *Client, in inbound) {
+	envelope := in.envelope
+
+	if !client.resuming {
+		h.unsubscribeResume(client)
+		h.reject(client, envelope, protocolError(errorBadRequest, "Resume is only possible once, on a connection opened with resume=1"))
+		return
+	}
+
+	// The members may have changed since prepareResume looked at them.
+	for _, roomID := range client.resumeRooms {
+		if members, cached := h.members.cached(roomID); cached && !members[client.userID] {
+			h.unsubscribeResume(client)
+			h.reject(client, envelope, protocolError(errorForbidden, "Not a member of room "+strconv.Itoa(roomID)))
+			return
+		}
+	}
+	client.resumeRooms = nil
+
+	for i := range in.resume.replay {
+		if in.resume.replay[i].DeletedAt == 0 {
+			h.send(client, Envelope{Type: typeMessage, Message: &in.resume.replay[i]})
+		}
+	}
+
+	ack := in.resume.ack
+	for c := range client.dropped {
+		if c.roomID != 0 {
+			ack.MoreRooms[strconv.Itoa(c.roomID)] = ""
+		} else {
+			ack.MoreDMs[strconv.Itoa(c.peerID)] = ""
+		}
+	}
+
+	client.replayed = in.resume.replayed
+	h.ack(client, envelope, Envelope{Resume: &ack})
+	h.endResume(client)
+}
+
+// missedMessages returns up to limit of the newest messages of a
+// conversation after the message lastSeenID, oldest first, together with the
+// position of the newest message of the conversation and whether older
+// missed messages were left out. Runs in the readPump, see prepare.
+func (h *Hub) missedMessages(userID int, c conversation, lastSeenID int64, limit int) ([]Message, *messageCursor, bool, *ProtocolError) {
+	var after *messageCursor
+	if lastSeenID != 0 {
+		message, err := h.store.getMessage(lastSeenID)
+		if err != nil && err != errNotFound {
+			log.Printf("error getting message: %v", err)
+			return nil, nil, false, protocolError(errorInternal, "Missed messages could not be read")
+		}
+
+		visible := false
+		if err == nil {
+			if visible, err = h.members.canRead(userID, message); err != nil {
+				log.Printf("error getting room members: %v", err)
+				return nil, nil, false, protocolError(errorInternal, "Missed messages could not be read")
+			}
+		}
+
+		if !visible || conversationOf(userID, message) != c {
+			return nil, nil, false, protocolError(errorInvalidMessage, "Message "+strconv.FormatInt(lastSeenID, 10)+" is not in the conversation")
+		}
+
+		cursor := cursorOf(message)
+		after = &cursor
+	}
+
+	page := historyPage{limit: limit + 1}
+
+	var messages []Message
+	var err error
+	if c.roomID != 0 {
+		messages, err = h.store.roomHistory(c.roomID, page)
+	} else {
+		messages, err = h.store.directHistory(userID, c.peerID, page)
+	}
+	if err != nil {
+		log.Printf("error reading history: %v", err)
+		return nil, nil, false, protocolError(errorInternal, "Missed messages could not be read")
+	}
+
+	newest := after
+	if len(messages) > 0 {
+		cursor := cursorOf(messages[len(messages)-1])
+		newest = &cursor
+	}
+
+	if after != nil {
+		missed := messages[:0]
+		for _, message := range messages {
+			if after.less(cursorOf(message)) {
+				missed = append(missed, message)
+			}
+		}
+		messages = missed
+	}
+
+	more := len(messages) > limit
+	if more {
+		messages = messages[len(messages)-limit:]
+	}
+
+	return messages, newest, more, nil
+}
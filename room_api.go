@@ -0,0 +1,234 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// serveCreateRoom creates a new room with the authenticated user as its
+// admin.
+func serveCreateRoom(hub *Hub, w http.ResponseWriter, r *http.Request, userID int) {
+	type CreateRoomRequest struct {
+		Name    string `json:"name"`
+		Picture string `json:"picture"`
+	}
+
+	log.Println(r.URL)
+
+	store := hub.store
+
+	var request CreateRoomRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+
+	if problem := validateName(request.Name); problem != "" {
+		writeJSONError(w, 400, problem)
+		return
+	}
+
+	if problem := validatePicture(request.Picture); problem != "" {
+		writeJSONError(w, 400, problem)
+		return
+	}
+
+	room := Room{Name: request.Name, Picture: request.Picture}
+	if err := store.createRoom(&room, userID); err != nil {
+		log.Printf("error creating room: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	// Members looked up before the room existed may have been cached.
+	hub.invalidate <- room.ID
+
+	writeJSON(w, 201, room)
+}
+
+// serveUpdateRoom renames a room or changes its picture. Only room admins
+// may do this.
+func serveUpdateRoom(store Store, w http.ResponseWriter, r *http.Request, userID int) {
+	type UpdateRoomRequest struct {
+		Name    *string `json:"name"`
+		Picture *string `json:"picture"`
+	}
+
+	log.Println(r.URL)
+
+	room, ok := roomFromPath(store, w, r)
+	if !ok {
+		return
+	}
+
+	if !requireRoomAdmin(store, w, room.ID, userID, "Only room admins can modify the room") {
+		return
+	}
+
+	var request UpdateRoomRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+
+	if request.Name != nil {
+		if problem := validateName(*request.Name); problem != "" {
+			writeJSONError(w, 400, problem)
+			return
+		}
+		room.Name = *request.Name
+	}
+
+	if request.Picture != nil {
+		if problem := validatePicture(*request.Picture); problem != "" {
+			writeJSONError(w, 400, problem)
+			return
+		}
+		room.Picture = *request.Picture
+	}
+
+	if err := store.updateRoom(room); err != nil {
+		log.Printf("error updating room: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	writeJSON(w, 200, room)
+}
+
+// serveAddRoomMember adds a user to a room. Only room admins may do this.
+func serveAddRoomMember(hub *Hub, w http.ResponseWriter, r *http.Request, userID int) {
+	type AddMemberRequest struct {
+		UserID  int  `json:"user_id"`
+		IsAdmin bool `json:"is_admin"`
+	}
+
+	log.Println(r.URL)
+
+	store := hub.store
+
+	room, ok := roomFromPath(store, w, r)
+	if !ok {
+		return
+	}
+
+	if !requireRoomAdmin(store, w, room.ID, userID, "Only room admins can add members") {
+		return
+	}
+
+	var request AddMemberRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+
+	if _, err := store.getUser(request.UserID); err != nil {
+		if err != errNotFound {
+			log.Printf("error getting user: %v", err)
+			writeJSONError(w, 500, "Internal server error")
+			return
+		}
+
+		writeJSONError(w, 404, "User not found")
+		return
+	}
+
+	if err := store.addRoomMember(room.ID, request.UserID, request.IsAdmin); err != nil {
+		if err == errAlreadyMember {
+			writeJSONError(w, 409, "User is already a member of the room")
+			return
+		}
+
+		log.Printf("error adding room member: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	hub.invalidate <- room.ID
+
+	w.WriteHeader(204)
+}
+
+// serveRemoveRoomMember removes a user from a room. Admins can remove anyone,
+// other members can only remove themselves.
+func serveRemoveRoomMember(hub *Hub, w http.ResponseWriter, r *http.Request, userID int) {
+	log.Println(r.URL)
+
+	store := hub.store
+
+	room, ok := roomFromPath(store, w, r)
+	if !ok {
+		return
+	}
+
+	memberID, err := strconv.Atoi(r.PathValue("user"))
+	if err != nil {
+		writeJSONError(w, 400, "Invalid user id")
+		return
+	}
+
+	if memberID != userID && !requireRoomAdmin(store, w, room.ID, userID, "Only room admins can remove other members") {
+		return
+	}
+
+	member, err := isRoomMember(store, room.ID, memberID)
+	if err != nil {
+		log.Printf("error checking room membership: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	if !member {
+		writeJSONError(w, 404, "User is not a member of the room")
+		return
+	}
+
+	if err := store.removeRoomMember(room.ID, memberID); err != nil {
+		log.Printf("error removing room member: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	hub.invalidate <- room.ID
+
+	w.WriteHeader(204)
+}
+
+// roomFromPath loads the room given in the {id} path parameter.
+func roomFromPath(store Store, w http.ResponseWriter, r *http.Request) (Room, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, 400, "Invalid room id")
+		return Room{}, false
+	}
+
+	room, err := store.getRoom(id)
+	if err != nil {
+		if err != errNotFound {
+			log.Printf("error getting room: %v", err)
+			writeJSONError(w, 500, "Internal server error")
+			return Room{}, false
+		}
+
+		writeJSONError(w, 404, "Room not found")
+		return Room{}, false
+	}
+
+	return room, true
+}
+
+// requireRoomAdmin checks that a user is an admin of a room, writing an
+// error response with the given message if not.
+func requireRoomAdmin(store Store, w http.ResponseWriter, roomID int, userID int, message string) bool {
+	isAdmin, err := store.isRoomAdmin(roomID, userID)
+	if err != nil {
+		log.Printf("error checking room admin: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return false
+	}
+
+	if !isAdmin {
+		writeJSONError(w, 403, message)
+		return false
+	}
+
+	return true
+}
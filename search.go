@@ -0,0 +1,277 @@
+package main
+
+import (
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Limits of a search query.
+const (
+	maxSearchQueryLength = 256
+	maxSearchWords       = 16
+)
+
+// Longest snippet returned with a search result, in characters, and how
+// much text is kept before the first match when the message is longer.
+const (
+	maxSnippetLength = 160
+	snippetLead      = 40
+)
+
+// searchQuery is a parsed search. A message matches when it contains every
+// term and every phrase, and passes the filters.
+type searchQuery struct {
+	terms   []string
+	phrases [][]string
+
+	// The text outside quotes and the quoted phrases as given, for the
+	// database to split into words with its own parser.
+	text        string
+	phraseTexts []string
+
+	// Filters, zero when not given. until is exclusive.
+	senderID int
+	since    int64
+	until    int64
+}
+
+// searchWords splits text into lowercase words at everything but letters and
+// digits. This is close to the simple text search configuration of the
+// database, but its parser also keeps email addresses, URLs, host names and
+// hyphenated words as words of their own. The in-memory store and the
+// snippets can thus differ from the database for such text.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// parseSearchQuery reads the words of a query. Text in double quotes is a
+// phrase whose words must follow each other.
+func parseSearchQuery(q string) (searchQuery, string) {
+	var query searchQuery
+
+	if len(q) > maxSearchQueryLength {
+		return query, "Query is too long"
+	}
+
+	count := 0
+	for i, part := range strings.Split(q, `"`) {
+		words := searchWords(part)
+		count += len(words)
+
+		// Every other part is inside quotes.
+		if i%2 == 1 && len(words) > 1 {
+			query.phrases = append(query.phrases, words)
+			query.phraseTexts = append(query.phraseTexts, part)
+		} else if len(words) > 0 {
+			query.terms = append(query.terms, words...)
+			query.text = strings.TrimSpace(query.text + " " + part)
+		}
+	}
+
+	if count == 0 {
+		return query, "Query must contain at least one word"
+	}
+
+	if count > maxSearchWords {
+		return query, "Query has too many words"
+	}
+
+	return query, ""
+}
+
+// matches reports whether the text of a message contains every term and
+// phrase of the query.
+func (q searchQuery) matches(text string) bool {
+	words := searchWords(text)
+
+	for _, term := range q.terms {
+		if !containsWords(words, []string{term}) {
+			return false
+		}
+	}
+
+	for _, phrase := range q.phrases {
+		if !containsWords(words, phrase) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// containsWords reports whether sequence appears in words.
+func containsWords(words []string, sequence []string) bool {
+	for i := 0; i+len(sequence) <= len(words); i++ {
+		found := true
+		for j, word := range sequence {
+			if words[i+j] != word {
+				found = false
+				break
+			}
+		}
+
+		if found {
+			return true
+		}
+	}
+
+	return false
+}
+
+// snippet returns the part of text around the first match as HTML, with the
+// words of the query wrapped in <mark> and everything else escaped.
+func (q searchQuery) snippet(text string) string {
+	wanted := make(map[string]bool)
+	for _, term := range q.terms {
+		wanted[term] = true
+	}
+	for _, phrase := range q.phrases {
+		for _, word := range phrase {
+			wanted[word] = true
+		}
+	}
+
+	runes := []rune(text)
+	isWordRune := func(i int) bool {
+		return unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])
+	}
+
+	// Ranges of the words to mark, as rune offsets.
+	var marks [][2]int
+	for i := 0; i < len(runes); {
+		if !isWordRune(i) {
+			i++
+			continue
+		}
+
+		end := i
+		for end < len(runes) && isWordRune(end) {
+			end++
+		}
+
+		if wanted[strings.ToLower(string(runes[i:end]))] {
+			marks = append(marks, [2]int{i, end})
+		}
+		i = end
+	}
+
+	start, end := 0, len(runes)
+	if len(runes) > maxSnippetLength {
+		if len(marks) > 0 {
+			start = max(0, min(marks[0][0]-snippetLead, len(runes)-maxSnippetLength))
+		}
+		end = start + maxSnippetLength
+	}
+
+	var snippet strings.Builder
+	if start > 0 {
+		snippet.WriteString("…")
+	}
+
+	position := start
+	for _, mark := range marks {
+		if mark[0] < start || mark[1] > end {
+			continue
+		}
+
+		snippet.WriteString(html.EscapeString(string(runes[position:mark[0]])))
+		snippet.WriteString("<mark>" + html.EscapeString(string(runes[mark[0]:mark[1]])) + "</mark>")
+		position = mark[1]
+	}
+	snippet.WriteString(html.EscapeString(string(runes[position:end])))
+
+	if end < len(runes) {
+		snippet.WriteString("…")
+	}
+
+	return snippet.String()
+}
+
+// parseSearchTime reads a date (2006-01-02) or an RFC 3339 time as a
+// millisecond timestamp. A date ending a range includes the whole day.
+func parseSearchTime(value string, end bool) (int64, bool) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		if t, err = time.Parse(time.DateOnly, value); err != nil {
+			return 0, false
+		}
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+	}
+
+	return t.UnixNano() / int64(time.Millisecond), true
+}
+
+// serveSearch finds messages of the rooms and direct conversations of the
+// authenticated user. The q parameter holds the words and "quoted phrases"
+// to find, sender limits the results to the messages of one user, and since
+// and until to a time range. Results come newest first and are paged like
+// history.
+func serveSearch(store Store, w http.ResponseWriter, r *http.Request, userID int) {
+	type SearchResult struct {
+		Message Message `json:"message"`
+		Snippet string  `json:"snippet"`
+	}
+
+	type SearchResponse struct {
+		Results    []SearchResult `json:"results"`
+		NextCursor string         `json:"next_cursor,omitempty"`
+	}
+
+	log.Println(r.URL)
+
+	params := r.URL.Query()
+
+	query, problem := parseSearchQuery(params.Get("q"))
+	if problem != "" {
+		writeJSONError(w, 400, problem)
+		return
+	}
+
+	if value := params.Get("sender"); value != "" {
+		senderID, err := strconv.Atoi(value)
+		if err != nil || senderID < 1 {
+			writeJSONError(w, 400, "Invalid sender")
+			return
+		}
+		query.senderID = senderID
+	}
+
+	var ok bool
+	if value := params.Get("since"); value != "" {
+		if query.since, ok = parseSearchTime(value, false); !ok {
+			writeJSONError(w, 400, "Invalid since, expected a date or an RFC 3339 time")
+			return
+		}
+	}
+
+	if value := params.Get("until"); value != "" {
+		if query.until, ok = parseSearchTime(value, true); !ok {
+			writeJSONError(w, 400, "Invalid until, expected a date or an RFC 3339 time")
+			return
+		}
+	}
+
+	history, ok := loadHistory(w, r, func(page historyPage) ([]Message, error) {
+		return store.searchMessages(userID, query, page)
+	})
+	if !ok {
+		return
+	}
+
+	response := SearchResponse{Results: []SearchResult{}, NextCursor: history.NextCursor}
+	for i := len(history.Messages) - 1; i >= 0; i-- {
+		message := history.Messages[i]
+		response.Results = append(response.Results, SearchResult{Message: message, Snippet: query.snippet(message.Message)})
+	}
+
+	writeJSON(w, 200, response)
+}
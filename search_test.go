@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	query, problem := parseSearchQuery(`Lunch "at the Café" tomorrow, "noon"`)
+	if problem != "" {
+		t.Fatal(problem)
+	}
+
+	if want := []string{"lunch", "tomorrow", "noon"}; !reflect.DeepEqual(query.terms, want) {
+		t.Errorf("terms = %q, want %q", query.terms, want)
+	}
+	if want := [][]string{{"at", "the", "café"}}; !reflect.DeepEqual(query.phrases, want) {
+		t.Errorf("phrases = %q, want %q", query.phrases, want)
+	}
+	if want := []string{"at the Café"}; !reflect.DeepEqual(query.phraseTexts, want) {
+		t.Errorf("phraseTexts = %q, want %q", query.phraseTexts, want)
+	}
+
+	for q, want := range map[string]string{
+		"":                                     "Query must contain at least one word",
+		`"" !?`:                                "Query must contain at least one word",
+		strings.Repeat("a ", maxSearchWords+1): "Query has too many words",
+		strings.Repeat("a", maxSearchQueryLength) + "a": "Query is too long",
+	} {
+		if _, problem := parseSearchQuery(q); problem != want {
+			t.Errorf("parseSearchQuery(%q) = %q, want %q", q, problem, want)
+		}
+	}
+}
+
+func TestSearchQueryMatches(t *testing.T) {
+	query, _ := parseSearchQuery(`lunch "the café"`)
+
+	tests := map[string]bool{
+		"Lunch at the Café?":    true,
+		"the café, then lunch":  true,
+		"Lunch at the old café": false,
+		"the café":              false,
+		"lunches at the café":   false,
+	}
+
+	for text, want := range tests {
+		if got := query.matches(text); got != want {
+			t.Errorf("matches(%q) = %v, want %v", text, got, want)
+		}
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	query, _ := parseSearchQuery("lunch")
+
+	if got, want := query.snippet("<b>Lunch</b> & more lunch"), "&lt;b&gt;<mark>Lunch</mark>&lt;/b&gt; &amp; more <mark>lunch</mark>"; got != want {
+		t.Errorf("snippet = %q, want %q", got, want)
+	}
+
+	// Long text is cut around the first match.
+	long := strings.Repeat("word ", 60) + "lunch" + strings.Repeat(" word", 60)
+	snippet := query.snippet(long)
+	if !strings.HasPrefix(snippet, "…") || !strings.HasSuffix(snippet, "…") || !strings.Contains(snippet, "<mark>lunch</mark>") {
+		t.Errorf("snippet = %q", snippet)
+	}
+	if text := strings.NewReplacer("<mark>", "", "</mark>", "", "…", "").Replace(snippet); len([]rune(text)) != maxSnippetLength {
+		t.Errorf("snippet has %d characters of text, want %d", len([]rune(text)), maxSnippetLength)
+	}
+	if lead := strings.Index(snippet, "<mark>") - len("…"); lead != snippetLead {
+		t.Errorf("snippet starts %d characters before the match, want %d", lead, snippetLead)
+	}
+}
+
+func TestParseSearchTime(t *testing.T) {
+	since, ok := parseSearchTime("2024-03-01", false)
+	until, ok2 := parseSearchTime("2024-03-01", true)
+	if !ok || !ok2 || until-since != 24*60*60*1000 {
+		t.Errorf("a day is %v..%v", since, until)
+	}
+
+	if at, ok := parseSearchTime("2024-03-01T12:00:00Z", true); !ok || at != since+12*60*60*1000 {
+		t.Errorf("parseSearchTime of a time = %v, %v", at, ok)
+	}
+
+	if _, ok := parseSearchTime("yesterday", false); ok {
+		t.Error("parseSearchTime of yesterday succeeded")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownOnSignal waits for SIGINT or SIGTERM and then stops the server
+// gracefully: no new connections or upgrades are accepted, the queued
+// messages are saved and every websocket is closed with a going away frame.
+// stopped is closed when that is done or the configured timeout has passed.
+func shutdownOnSignal(server *http.Server, hub *Hub, stopped chan bool) {
+	defer close(stopped)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+
+	// A second signal kills the server right away.
+	signal.Stop(signals)
+	log.Printf("got %v, shutting down", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Shutdown.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("error shutting down the http server: %v", err)
+	}
+
+	if err := hub.drain(ctx); err != nil {
+		log.Printf("clients were not drained before the shutdown timeout: %v", err)
+		return
+	}
+
+	log.Println("all clients drained")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+var (
+	// errNotFound is returned when the requested row does not exist.
+	errNotFound = errors.New("not found")
+
+	// errEmailTaken is returned when another user already has the email.
+	errEmailTaken = errors.New("email is already in use")
+
+	// errAlreadyMember is returned when adding a user to a room twice.
+	errAlreadyMember = errors.New("user is already a member of the room")
+
+	// errMessageDeleted is returned when changing a deleted message.
+	errMessageDeleted = errors.New("message has been deleted")
+
+	// errAttachmentTaken is returned when inserting a message with an
+	// attachment that has already been sent in another message.
+	errAttachmentTaken = errors.New("attachment has already been sent")
+)
+
+// Store keeps the users, rooms, memberships, conversations and messages of
+// the chat. Handlers and the hub only access data through it.
+type Store interface {
+	// Users
+	getUser(id int) (User, error)
+	getUserByEmail(email string) (User, error)
+	createUser(user *User) error
+	updateUser(user User) error
+	setPassword(userID int, hash string) error
+	setLastSeen(userID int, lastSeen time.Time) error
+	deleteUser(id int) ([]Attachment, error)
+
+	// Rooms
+	getRoom(id int) (Room, error)
+	createRoom(room *Room, adminID int) error
+	updateRoom(room Room) error
+	userRooms(userID int) ([]Room, error)
+
+	// Memberships
+	roomMembers(roomID int) ([]int, error)
+	isRoomAdmin(roomID int, userID int) (bool, error)
+	addRoomMember(roomID int, userID int, isAdmin bool) error
+	removeRoomMember(roomID int, userID int) error
+
+	// Conversations
+	conversations(userID int) ([]User, error)
+	hasConversation(userID int, peerID int) (bool, error)
+
+	// Messages
+	getMessage(id int64) (Message, error)
+	insertMessages(messages []Message) ([]int64, error)
+	editMessage(id int64, text string, editorID int, editedAt int64) error
+	deleteMessage(id int64, deletedAt int64) error
+	messageEdits(id int64) ([]MessageEdit, error)
+	roomMessages(roomID int) ([]Message, error)
+	directMessages(userID int, peerID int) ([]Message, error)
+
+	// Reactions, oldest first
+	addReaction(messageID int64, userID int, emoji string) (bool, error)
+	removeReaction(messageID int64, userID int, emoji string) (bool, error)
+	messageReactions(messageIDs []int64) ([]Reaction, error)
+
+	// History pages, oldest message first
+	roomHistory(roomID int, page historyPage) ([]Message, error)
+	directHistory(userID int, peerID int, page historyPage) ([]Message, error)
+	threadHistory(rootID int64, page historyPage) ([]Message, error)
+	searchMessages(userID int, query searchQuery, page historyPage) ([]Message, error)
+
+	// Attachments. Inserting a message links the attachments in it.
+	createAttachment(attachment *Attachment) error
+	getAttachment(id int64) (Attachment, error)
+	messageAttachments(messageIDs []int64) ([]Attachment, error)
+	deleteStaleAttachments(uploadedBefore int64) ([]Attachment, error)
+
+	// Threads
+	threadSummaries(rootIDs []int64) (map[int64]ThreadSummary, error)
+	threadParticipants(rootID int64) ([]int, error)
+
+	// Read markers of a room (peerID 0) or a direct conversation (roomID 0)
+	markRead(userID int, roomID int, peerID int, messageID int64) (int64, error)
+	conversationStates(userID int) (map[conversation]conversationState, error)
+}
+
+// isRoomMember checks whether a user is a member of a room.
+func isRoomMember(store Store, roomID int, userID int) (bool, error) {
+	members, err := store.roomMembers(roomID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, memberID := range members {
+		if memberID == userID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// canReadMessage checks whether a user is a participant of the conversation
+// a message belongs to.
+func canReadMessage(store Store, userID int, message Message) (bool, error) {
+	if message.RoomID != "" {
+		roomID, _ := strconv.Atoi(message.RoomID)
+		return isRoomMember(store, roomID, userID)
+	}
+
+	user := strconv.Itoa(userID)
+
+	return message.Sender == user || message.Receiver == user, nil
+}
@@ -0,0 +1,960 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store that keeps everything in memory. It is meant for
+// running the server without a database.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	users    map[int]User
+	rooms    map[int]Room
+	messages []Message
+
+	// Room ID -> user ID -> whether the user is an admin of the room.
+	members map[int]map[int]bool
+
+	// Pairs of users having a conversation, smaller user ID first.
+	conversationPairs map[[2]int]bool
+
+	// User ID, room ID, peer ID -> last read message ID.
+	readMarkers map[[3]int]int64
+
+	// Earlier texts of edited messages by message ID.
+	edits map[int64][]MessageEdit
+
+	// Reactions in the order they were added.
+	reactions []Reaction
+
+	// Attachments in the order they were uploaded.
+	attachments []Attachment
+
+	// Last IDs handed out.
+	lastUserID       int
+	lastRoomID       int
+	lastMessageID    int64
+	lastAttachmentID int64
+}
+
+func newMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:             make(map[int]User),
+		rooms:             make(map[int]Room),
+		members:           make(map[int]map[int]bool),
+		conversationPairs: make(map[[2]int]bool),
+		readMarkers:       make(map[[3]int]int64),
+		edits:             make(map[int64][]MessageEdit),
+	}
+}
+
+func (s *MemoryStore) getUser(id int) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return user, errNotFound
+	}
+
+	return user, nil
+}
+
+func (s *MemoryStore) getUserByEmail(email string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+
+	return User{}, errNotFound
+}
+
+// emailTaken reports whether a user other than id has the email. The caller
+// must hold the lock.
+func (s *MemoryStore) emailTaken(email string, id int) bool {
+	for _, user := range s.users {
+		if user.Email == email && user.ID != id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *MemoryStore) createUser(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.emailTaken(user.Email, 0) {
+		return errEmailTaken
+	}
+
+	s.lastUserID++
+	user.ID = s.lastUserID
+	user.LastSeen = time.Now().Format(time.RFC3339Nano)
+	s.users[user.ID] = *user
+
+	return nil
+}
+
+func (s *MemoryStore) updateUser(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.users[user.ID]
+	if !ok {
+		return errNotFound
+	}
+
+	if s.emailTaken(user.Email, user.ID) {
+		return errEmailTaken
+	}
+
+	stored.Name = user.Name
+	stored.Email = user.Email
+	stored.ProfilePicture = user.ProfilePicture
+	s.users[user.ID] = stored
+
+	return nil
+}
+
+func (s *MemoryStore) setPassword(userID int, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return errNotFound
+	}
+
+	user.Password = hash
+	s.users[userID] = user
+
+	return nil
+}
+
+// setLastSeen keeps the later time if last_seen is already set.
+func (s *MemoryStore) setLastSeen(userID int, lastSeen time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return errNotFound
+	}
+
+	if previous, err := time.Parse(time.RFC3339Nano, user.LastSeen); err == nil && !previous.Before(lastSeen) {
+		return nil
+	}
+
+	user.LastSeen = lastSeen.Format(time.RFC3339Nano)
+	s.users[userID] = user
+
+	return nil
+}
+
+// deleteUser deletes a user together with its direct messages and returns
+// the deleted attachments. Its room messages are kept as tombstones without
+// a sender for the replies to them, and the rooms it was the only admin of
+// get their member with the lowest ID as admin.
+func (s *MemoryStore) deleteUser(id int) ([]Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := strconv.Itoa(id)
+	deletedAt := time.Now().UnixNano() / int64(time.Millisecond)
+
+	// Messages dropped or turned into tombstones.
+	removed := make(map[int64]bool)
+
+	messages := s.messages[:0]
+	for _, message := range s.messages {
+		if message.RoomID == "" && (message.Sender == user || message.Receiver == user) {
+			removed[message.ID] = true
+			delete(s.edits, message.ID)
+			continue
+		}
+
+		if message.Sender == user {
+			removed[message.ID] = true
+			delete(s.edits, message.ID)
+			message.Sender = ""
+			message.Message = ""
+			if message.DeletedAt == 0 {
+				message.DeletedAt = deletedAt
+			}
+		}
+		if message.Receiver == user {
+			message.Receiver = ""
+		}
+		messages = append(messages, message)
+	}
+	s.messages = messages
+
+	s.removeReactions(func(reaction Reaction) bool {
+		return reaction.UserID == user || removed[reaction.MessageID]
+	})
+
+	var deleted []Attachment
+	attachments := s.attachments[:0]
+	for _, attachment := range s.attachments {
+		if attachment.uploaderID != id && !removed[attachment.MessageID] {
+			attachments = append(attachments, attachment)
+		} else {
+			deleted = append(deleted, attachment)
+		}
+	}
+	s.attachments = attachments
+
+	for messageID, edits := range s.edits {
+		kept := edits[:0]
+		for _, edit := range edits {
+			if edit.EditedBy != user {
+				kept = append(kept, edit)
+			}
+		}
+		s.edits[messageID] = kept
+	}
+
+	for _, members := range s.members {
+		wasAdmin := members[id]
+		delete(members, id)
+		if wasAdmin {
+			s.keepAdmin(members)
+		}
+	}
+
+	for pair := range s.conversationPairs {
+		if pair[0] == id || pair[1] == id {
+			delete(s.conversationPairs, pair)
+		}
+	}
+
+	for key := range s.readMarkers {
+		if key[0] == id || key[2] == id {
+			delete(s.readMarkers, key)
+		}
+	}
+
+	delete(s.users, id)
+
+	return deleted, nil
+}
+
+// keepAdmin makes the member with the lowest ID the admin of a room that
+// has members but no admin. The caller must hold the lock.
+func (s *MemoryStore) keepAdmin(members map[int]bool) {
+	lowest := 0
+	for userID, isAdmin := range members {
+		if isAdmin {
+			return
+		}
+		if lowest == 0 || userID < lowest {
+			lowest = userID
+		}
+	}
+
+	if lowest != 0 {
+		members[lowest] = true
+	}
+}
+
+func (s *MemoryStore) getRoom(id int) (Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, ok := s.rooms[id]
+	if !ok {
+		return room, errNotFound
+	}
+
+	return room, nil
+}
+
+// createRoom creates a new room with the given user as its admin.
+func (s *MemoryStore) createRoom(room *Room, adminID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[adminID]; !ok {
+		return errNotFound
+	}
+
+	s.lastRoomID++
+	room.ID = s.lastRoomID
+	s.rooms[room.ID] = *room
+	s.members[room.ID] = map[int]bool{adminID: true}
+
+	return nil
+}
+
+func (s *MemoryStore) updateRoom(room Room) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rooms[room.ID]; !ok {
+		return errNotFound
+	}
+
+	s.rooms[room.ID] = room
+
+	return nil
+}
+
+func (s *MemoryStore) userRooms(userID int) ([]Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rooms []Room
+	for roomID, members := range s.members {
+		if _, ok := members[userID]; ok {
+			rooms = append(rooms, s.rooms[roomID])
+		}
+	}
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].ID < rooms[j].ID })
+
+	return rooms, nil
+}
+
+func (s *MemoryStore) roomMembers(roomID int) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var members []int
+	for userID := range s.members[roomID] {
+		members = append(members, userID)
+	}
+
+	return members, nil
+}
+
+func (s *MemoryStore) isRoomAdmin(roomID int, userID int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.members[roomID][userID], nil
+}
+
+func (s *MemoryStore) addRoomMember(roomID int, userID int, isAdmin bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rooms[roomID]; !ok {
+		return errNotFound
+	}
+
+	if _, ok := s.users[userID]; !ok {
+		return errNotFound
+	}
+
+	if _, ok := s.members[roomID][userID]; ok {
+		return errAlreadyMember
+	}
+
+	s.members[roomID][userID] = isAdmin
+
+	return nil
+}
+
+func (s *MemoryStore) removeRoomMember(roomID int, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.members[roomID], userID)
+
+	return nil
+}
+
+// addConversation starts a conversation between two users.
+func (s *MemoryStore) addConversation(userID int, receiverID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conversationPairs[conversationPair(userID, receiverID)] = true
+}
+
+func (s *MemoryStore) conversations(userID int) ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var conversations []User
+	for pair := range s.conversationPairs {
+		peerID := pair[0]
+		if peerID == userID {
+			peerID = pair[1]
+		} else if pair[1] != userID {
+			continue
+		}
+
+		if peer, ok := s.users[peerID]; ok {
+			peer.Password = ""
+			conversations = append(conversations, peer)
+		}
+	}
+
+	sort.Slice(conversations, func(i, j int) bool { return conversations[i].ID < conversations[j].ID })
+
+	return conversations, nil
+}
+
+func (s *MemoryStore) hasConversation(userID int, peerID int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conversationPairs[conversationPair(userID, peerID)], nil
+}
+
+func conversationPair(a int, b int) [2]int {
+	if a > b {
+		a, b = b, a
+	}
+
+	return [2]int{a, b}
+}
+
+func (s *MemoryStore) getMessage(id int64) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i := s.messageIndex(id); i >= 0 {
+		return s.messages[i], nil
+	}
+
+	return Message{}, errNotFound
+}
+
+// messageIndex returns the position of a message in s.messages or -1. The
+// caller must hold the lock.
+func (s *MemoryStore) messageIndex(id int64) int {
+	for i, message := range s.messages {
+		if message.ID == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (s *MemoryStore) editMessage(id int64, text string, editorID int, editedAt int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.messageIndex(id)
+	if i < 0 || s.messages[i].DeletedAt != 0 {
+		return errNotFound
+	}
+
+	s.edits[id] = append(s.edits[id], MessageEdit{Message: s.messages[i].Message, EditedBy: strconv.Itoa(editorID), EditedAt: editedAt})
+	s.messages[i].Message = text
+	s.messages[i].EditedAt = editedAt
+
+	return nil
+}
+
+func (s *MemoryStore) deleteMessage(id int64, deletedAt int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.messageIndex(id)
+	if i < 0 || s.messages[i].DeletedAt != 0 {
+		return errNotFound
+	}
+
+	delete(s.edits, id)
+	s.removeReactions(func(reaction Reaction) bool { return reaction.MessageID == id })
+	s.messages[i].Message = ""
+	s.messages[i].DeletedAt = deletedAt
+
+	return nil
+}
+
+func (s *MemoryStore) messageEdits(id int64) ([]MessageEdit, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]MessageEdit(nil), s.edits[id]...), nil
+}
+
+// removeReactions drops the reactions matching drop and reports whether
+// there were any. The caller must hold the lock.
+func (s *MemoryStore) removeReactions(drop func(Reaction) bool) bool {
+	removed := false
+	reactions := s.reactions[:0]
+	for _, reaction := range s.reactions {
+		if drop(reaction) {
+			removed = true
+			continue
+		}
+		reactions = append(reactions, reaction)
+	}
+	s.reactions = reactions
+
+	return removed
+}
+
+func (s *MemoryStore) addReaction(messageID int64, userID int, emoji string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.messageIndex(messageID) < 0 {
+		return false, errors.New("message does not exist")
+	}
+
+	reaction := Reaction{MessageID: messageID, UserID: strconv.Itoa(userID), Emoji: emoji}
+	for _, existing := range s.reactions {
+		if existing == reaction {
+			return false, nil
+		}
+	}
+	s.reactions = append(s.reactions, reaction)
+
+	return true, nil
+}
+
+func (s *MemoryStore) removeReaction(messageID int64, userID int, emoji string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reaction := Reaction{MessageID: messageID, UserID: strconv.Itoa(userID), Emoji: emoji}
+
+	return s.removeReactions(func(existing Reaction) bool { return existing == reaction }), nil
+}
+
+func (s *MemoryStore) messageReactions(messageIDs []int64) ([]Reaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := make(map[int64]bool)
+	for _, id := range messageIDs {
+		wanted[id] = true
+	}
+
+	var reactions []Reaction
+	for _, reaction := range s.reactions {
+		if wanted[reaction.MessageID] {
+			reactions = append(reactions, reaction)
+		}
+	}
+
+	return reactions, nil
+}
+
+// insertMessages stores a batch of messages and returns their IDs. Like a
+// transaction, either every message is stored or none of them is.
+func (s *MemoryStore) insertMessages(messages []Message) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Attachments taken by an earlier message of the batch.
+	taken := make(map[int64]bool)
+
+	for _, message := range messages {
+		if err := s.checkReferences(message); err != nil {
+			return nil, err
+		}
+
+		for _, attachment := range message.Attachments {
+			i := s.attachmentIndex(attachment.ID)
+			if i < 0 || s.attachments[i].MessageID != 0 || taken[attachment.ID] {
+				return nil, errAttachmentTaken
+			}
+			taken[attachment.ID] = true
+		}
+	}
+
+	ids := make([]int64, len(messages))
+	for i, message := range messages {
+		s.lastMessageID++
+		message.ID = s.lastMessageID
+		ids[i] = message.ID
+
+		for _, attachment := range message.Attachments {
+			s.attachments[s.attachmentIndex(attachment.ID)].MessageID = message.ID
+		}
+
+		// Attachments are kept apart like in the attachments table.
+		message.Attachments = nil
+		s.messages = append(s.messages, message)
+
+		if message.RoomID == "" {
+			senderID, _ := strconv.Atoi(message.Sender)
+			receiverID, _ := strconv.Atoi(message.Receiver)
+			s.conversationPairs[conversationPair(senderID, receiverID)] = true
+		}
+	}
+
+	return ids, nil
+}
+
+func (s *MemoryStore) createAttachment(attachment *Attachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[attachment.uploaderID]; !ok {
+		return errors.New("uploader does not exist")
+	}
+
+	s.lastAttachmentID++
+	attachment.ID = s.lastAttachmentID
+	s.attachments = append(s.attachments, *attachment)
+
+	return nil
+}
+
+func (s *MemoryStore) getAttachment(id int64) (Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.attachmentIndex(id)
+	if i < 0 {
+		return Attachment{}, errNotFound
+	}
+
+	return s.attachments[i], nil
+}
+
+func (s *MemoryStore) attachmentIndex(id int64) int {
+	for i, attachment := range s.attachments {
+		if attachment.ID == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (s *MemoryStore) messageAttachments(messageIDs []int64) ([]Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := make(map[int64]bool)
+	for _, id := range messageIDs {
+		wanted[id] = true
+	}
+
+	var attachments []Attachment
+	for _, attachment := range s.attachments {
+		if wanted[attachment.MessageID] {
+			attachments = append(attachments, attachment)
+		}
+	}
+
+	return attachments, nil
+}
+
+// deleteStaleAttachments deletes the attachments uploaded before the given
+// time and never sent, and the attachments of deleted messages.
+func (s *MemoryStore) deleteStaleAttachments(uploadedBefore int64) ([]Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted []Attachment
+	attachments := s.attachments[:0]
+	for _, attachment := range s.attachments {
+		stale := attachment.MessageID == 0 && attachment.CreatedAt < uploadedBefore
+		if i := s.messageIndex(attachment.MessageID); attachment.MessageID != 0 && i >= 0 && s.messages[i].DeletedAt != 0 {
+			stale = true
+		}
+
+		if stale {
+			deleted = append(deleted, attachment)
+		} else {
+			attachments = append(attachments, attachment)
+		}
+	}
+	s.attachments = attachments
+
+	return deleted, nil
+}
+
+// checkReferences makes sure the users and room of a message exist, like the
+// foreign keys of the chatlog table do. The caller must hold the lock.
+func (s *MemoryStore) checkReferences(message Message) error {
+	senderID, err := strconv.Atoi(message.Sender)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := s.users[senderID]; !ok {
+		return errors.New("sender does not exist")
+	}
+
+	if message.Receiver != "" {
+		receiverID, err := strconv.Atoi(message.Receiver)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := s.users[receiverID]; !ok {
+			return errors.New("receiver does not exist")
+		}
+	}
+
+	if message.RoomID != "" {
+		roomID, err := strconv.Atoi(message.RoomID)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := s.rooms[roomID]; !ok {
+			return errors.New("room does not exist")
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) roomMessages(roomID int) ([]Message, error) {
+	room := strconv.Itoa(roomID)
+
+	return s.filterMessages(func(message Message) bool {
+		return message.RoomID == room
+	}), nil
+}
+
+func (s *MemoryStore) directMessages(userID int, peerID int) ([]Message, error) {
+	user, peer := strconv.Itoa(userID), strconv.Itoa(peerID)
+
+	return s.filterMessages(func(message Message) bool {
+		return message.RoomID == "" &&
+			((message.Sender == user && message.Receiver == peer) || (message.Sender == peer && message.Receiver == user))
+	}), nil
+}
+
+func (s *MemoryStore) roomHistory(roomID int, page historyPage) ([]Message, error) {
+	messages, err := s.roomMessages(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	return paginate(messages, page), nil
+}
+
+func (s *MemoryStore) directHistory(userID int, peerID int, page historyPage) ([]Message, error) {
+	messages, err := s.directMessages(userID, peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	return paginate(messages, page), nil
+}
+
+func (s *MemoryStore) searchMessages(userID int, query searchQuery, page historyPage) ([]Message, error) {
+	rooms, err := s.userRooms(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	roomIDs := make(map[string]bool)
+	for _, room := range rooms {
+		roomIDs[strconv.Itoa(room.ID)] = true
+	}
+
+	user, sender := strconv.Itoa(userID), strconv.Itoa(query.senderID)
+
+	return paginate(s.filterMessages(func(message Message) bool {
+		if message.RoomID != "" && !roomIDs[message.RoomID] {
+			return false
+		}
+		if message.RoomID == "" && message.Sender != user && message.Receiver != user {
+			return false
+		}
+
+		return message.DeletedAt == 0 &&
+			(query.senderID == 0 || message.Sender == sender) &&
+			(query.since == 0 || message.Timestamp >= query.since) &&
+			(query.until == 0 || message.Timestamp < query.until) &&
+			query.matches(message.Message)
+	}), page), nil
+}
+
+// inConversation reports whether a message is in a room, or in the direct
+// conversation between userID and peerID if roomID is 0.
+func inConversation(message Message, userID int, roomID int, peerID int) bool {
+	if roomID != 0 {
+		return message.RoomID == strconv.Itoa(roomID)
+	}
+
+	user, peer := strconv.Itoa(userID), strconv.Itoa(peerID)
+
+	return message.RoomID == "" &&
+		((message.Sender == user && message.Receiver == peer) || (message.Sender == peer && message.Receiver == user))
+}
+
+func (s *MemoryStore) markRead(userID int, roomID int, peerID int, messageID int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.messageIndex(messageID)
+	if i < 0 || !inConversation(s.messages[i], userID, roomID, peerID) {
+		return 0, errNotFound
+	}
+
+	key := [3]int{userID, roomID, peerID}
+	if messageID > s.readMarkers[key] {
+		s.readMarkers[key] = messageID
+	}
+
+	return s.readMarkers[key], nil
+}
+
+func (s *MemoryStore) conversationStates(userID int) (map[conversation]conversationState, error) {
+	rooms, err := s.userRooms(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	roomIDs := make(map[string]bool)
+	for _, room := range rooms {
+		roomIDs[strconv.Itoa(room.ID)] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := strconv.Itoa(userID)
+	states := make(map[conversation]conversationState)
+	for _, message := range s.messages {
+		if message.RoomID != "" && !roomIDs[message.RoomID] {
+			continue
+		}
+		if message.RoomID == "" && message.Sender != user && message.Receiver != user {
+			continue
+		}
+
+		c := conversationOf(userID, message)
+		state := states[c]
+
+		if state.latest == nil || cursorOf(*state.latest).less(cursorOf(message)) {
+			latest := message
+			state.latest = &latest
+		}
+
+		if message.Sender != user && message.DeletedAt == 0 && message.ID > s.readMarkers[[3]int{userID, c.roomID, c.peerID}] {
+			state.unread++
+		}
+
+		states[c] = state
+	}
+
+	return states, nil
+}
+
+func (s *MemoryStore) threadHistory(rootID int64, page historyPage) ([]Message, error) {
+	messages := s.filterMessages(func(message Message) bool {
+		return message.ThreadRoot == rootID
+	})
+
+	return paginate(messages, page), nil
+}
+
+func (s *MemoryStore) threadSummaries(rootIDs []int64) (map[int64]ThreadSummary, error) {
+	wanted := make(map[int64]bool)
+	for _, id := range rootIDs {
+		wanted[id] = true
+	}
+
+	// Replies come oldest first, so the last one seen is the latest.
+	summaries := make(map[int64]ThreadSummary)
+	for _, reply := range s.filterMessages(func(message Message) bool {
+		return wanted[message.ThreadRoot] && message.DeletedAt == 0
+	}) {
+		summary := summaries[reply.ThreadRoot]
+		summary.ReplyCount++
+		summary.LastReplyID = reply.ID
+		summary.LastReplySender = reply.Sender
+		summary.LastReplyAt = reply.Timestamp
+		summaries[reply.ThreadRoot] = summary
+	}
+
+	return summaries, nil
+}
+
+func (s *MemoryStore) threadParticipants(rootID int64) ([]int, error) {
+	seen := make(map[int]bool)
+	var participants []int
+	for _, message := range s.filterMessages(func(message Message) bool {
+		return message.ID == rootID || message.ThreadRoot == rootID
+	}) {
+		userID, err := strconv.Atoi(message.Sender)
+		if err != nil || seen[userID] {
+			continue
+		}
+
+		seen[userID] = true
+		participants = append(participants, userID)
+	}
+
+	return participants, nil
+}
+
+// filterMessages returns the messages matching keep, oldest first.
+func (s *MemoryStore) filterMessages(keep func(Message) bool) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var messages []Message
+	for _, message := range s.messages {
+		if keep(message) {
+			messages = append(messages, message)
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return cursorOf(messages[i]).less(cursorOf(messages[j]))
+	})
+
+	return messages
+}
+
+// seedMemoryStore creates the same default data as a freshly migrated
+// database so that the in-memory server can be tried out right away.
+func seedMemoryStore(s *MemoryStore) {
+	var users []User
+	for _, user := range []User{
+		{Name: "Superadmin", Email: "admin@haloochat.dev", Password: "password", ProfilePicture: "admin.jpg"},
+		{Name: "Superadmin2", Email: "admin2@haloochat.dev", Password: "password2", ProfilePicture: "admin2.jpg"},
+	} {
+		hash, err := hashPassword(user.Password)
+		if err != nil {
+			log.Printf("error hashing default user password: %v", err)
+			return
+		}
+
+		user.Password = hash
+		if err := s.createUser(&user); err != nil {
+			log.Printf("error creating default user: %v", err)
+			return
+		}
+		users = append(users, user)
+	}
+
+	room := Room{Name: "Welcome", Picture: "placeholder.jpg"}
+	if err := s.createRoom(&room, users[0].ID); err != nil {
+		log.Printf("error creating default room: %v", err)
+		return
+	}
+
+	s.addConversation(users[0].ID, users[1].ID)
+
+	first, second := strconv.Itoa(users[0].ID), strconv.Itoa(users[1].ID)
+	if _, err := s.insertMessages([]Message{
+		{Sender: first, Message: "Testataan kannan kautta tulevia viestejä", RoomID: strconv.Itoa(room.ID), Timestamp: 1513012789379},
+		{Sender: first, Receiver: second, Message: "Testataan kannan kautta tulevia priva viestejä", Timestamp: 1513012789379},
+		{Sender: second, Receiver: first, Message: "Mennäänkö kauppaan", Timestamp: 1513012789380},
+		{Sender: second, Receiver: first, Message: "Pakko saaha jotai juotavaa", Timestamp: 1513012789395},
+	}); err != nil {
+		log.Printf("error creating default messages: %v", err)
+	}
+}
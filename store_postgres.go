@@ -0,0 +1,831 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Chatlog columns read by scanMessage.
+const messageColumns = "id, sender, receiver, message, room_id, timestamp, edited_at, deleted_at, reply_to, thread_root"
+
+// Attachment columns read by scanAttachment.
+const attachmentColumns = "id, uploader_id, message_id, name, content_type, size, width, height, blob_key, thumbnail_key, created_at"
+
+// PostgresStore is a Store backed by CockroachDB or PostgreSQL.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func newPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// notFound turns sql.ErrNoRows into errNotFound.
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+
+	return err
+}
+
+// isUniqueViolation reports whether err is a unique constraint violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func (s *PostgresStore) getUser(id int) (User, error) {
+	var user User
+
+	err := s.db.QueryRow("SELECT id, name, email, password, last_seen, profile_picture FROM chat_users WHERE id = $1;", id).Scan(&user.ID, &user.Name, &user.Email, &user.Password, &user.LastSeen, &user.ProfilePicture)
+
+	return user, notFound(err)
+}
+
+func (s *PostgresStore) getUserByEmail(email string) (User, error) {
+	var user User
+
+	err := s.db.QueryRow("SELECT id, name, email, password, last_seen, profile_picture FROM chat_users WHERE email = $1;", email).Scan(&user.ID, &user.Name, &user.Email, &user.Password, &user.LastSeen, &user.ProfilePicture)
+
+	return user, notFound(err)
+}
+
+func (s *PostgresStore) createUser(user *User) error {
+	err := s.db.QueryRow("INSERT INTO chat_users (name, email, password, last_seen, profile_picture) VALUES ($1, $2, $3, now(), $4) RETURNING id, last_seen;", user.Name, user.Email, user.Password, user.ProfilePicture).Scan(&user.ID, &user.LastSeen)
+	if isUniqueViolation(err) {
+		return errEmailTaken
+	}
+
+	return err
+}
+
+func (s *PostgresStore) updateUser(user User) error {
+	_, err := s.db.Exec("UPDATE chat_users SET name = $1, email = $2, profile_picture = $3 WHERE id = $4;", user.Name, user.Email, user.ProfilePicture, user.ID)
+	if isUniqueViolation(err) {
+		return errEmailTaken
+	}
+
+	return err
+}
+
+func (s *PostgresStore) setPassword(userID int, hash string) error {
+	_, err := s.db.Exec("UPDATE chat_users SET password = $1 WHERE id = $2;", hash, userID)
+
+	return err
+}
+
+// setLastSeen keeps the later time if last_seen is already set.
+func (s *PostgresStore) setLastSeen(userID int, lastSeen time.Time) error {
+	_, err := s.db.Exec("UPDATE chat_users SET last_seen = $1 WHERE id = $2 AND (last_seen IS NULL OR last_seen < $1);", lastSeen, userID)
+
+	return err
+}
+
+// deleteUser deletes a user together with its direct messages and returns
+// the deleted attachments, whose blobs are left to the caller. Its room
+// messages are kept as tombstones without a sender for the replies to them,
+// and the rooms it was the only admin of get their member with the lowest ID
+// as admin.
+func (s *PostgresStore) deleteUser(id int) ([]Attachment, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, query := range []string{
+		"DELETE FROM message_edits WHERE edited_by = $1 OR message_id IN (SELECT id FROM chatlog WHERE sender = $1 OR (receiver = $1 AND room_id IS NULL));",
+		"DELETE FROM message_reactions WHERE user_id = $1 OR message_id IN (SELECT id FROM chatlog WHERE sender = $1 OR (receiver = $1 AND room_id IS NULL));",
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	attachments, err := deleteAttachments(tx, "uploader_id = $1 OR message_id IN (SELECT id FROM chatlog WHERE sender = $1 OR (receiver = $1 AND room_id IS NULL))", id)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	deletedAt := time.Now().UnixNano() / int64(time.Millisecond)
+	if _, err := tx.Exec("UPDATE chatlog SET sender = NULL, message = '', deleted_at = COALESCE(deleted_at, $2) WHERE sender = $1 AND room_id IS NOT NULL;", id, deletedAt); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	for _, query := range []string{
+		"DELETE FROM chatlog WHERE room_id IS NULL AND (sender = $1 OR receiver = $1);",
+		// Room messages from before receivers were refused on them.
+		"UPDATE chatlog SET receiver = NULL WHERE receiver = $1;",
+		"UPDATE room_has_users SET is_admin = true WHERE (room_id, user_id) IN (SELECT room_id, min(user_id) FROM room_has_users WHERE user_id != $1 AND room_id IN (SELECT room_id FROM room_has_users WHERE user_id = $1 AND is_admin) AND room_id NOT IN (SELECT room_id FROM room_has_users WHERE user_id != $1 AND is_admin) GROUP BY room_id);",
+		"DELETE FROM room_has_users WHERE user_id = $1;",
+		"DELETE FROM user_conversations WHERE user_id = $1 OR receiver_user_id = $1;",
+		"DELETE FROM read_markers WHERE user_id = $1 OR peer_id = $1;",
+		"DELETE FROM chat_users WHERE id = $1;",
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	return attachments, tx.Commit()
+}
+
+// deleteAttachments deletes the attachments matching a condition and returns
+// them.
+func deleteAttachments(db interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}, where string, args ...interface{}) ([]Attachment, error) {
+	rows, err := db.Query("DELETE FROM attachments WHERE "+where+" RETURNING "+attachmentColumns+";", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, rows.Err()
+}
+
+func (s *PostgresStore) getRoom(id int) (Room, error) {
+	var room Room
+
+	err := s.db.QueryRow("SELECT id, name, picture FROM rooms WHERE id = $1;", id).Scan(&room.ID, &room.Name, &room.Picture)
+
+	return room, notFound(err)
+}
+
+// createRoom creates a new room with the given user as its admin.
+func (s *PostgresStore) createRoom(room *Room, adminID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := tx.QueryRow("INSERT INTO rooms (name, picture) VALUES ($1, $2) RETURNING id;", room.Name, room.Picture).Scan(&room.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec("INSERT INTO room_has_users (room_id, user_id, is_admin) VALUES ($1, $2, true);", room.ID, adminID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) updateRoom(room Room) error {
+	_, err := s.db.Exec("UPDATE rooms SET name = $1, picture = $2 WHERE id = $3;", room.Name, room.Picture, room.ID)
+
+	return err
+}
+
+func (s *PostgresStore) userRooms(userID int) ([]Room, error) {
+	var rooms []Room
+
+	rows, err := s.db.Query("SELECT id, name, picture FROM rooms r WHERE id IN (SELECT room_id FROM room_has_users rh WHERE rh.user_id = $1) ORDER BY id;", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var room Room
+		if err := rows.Scan(&room.ID, &room.Name, &room.Picture); err != nil {
+			return nil, err
+		}
+
+		rooms = append(rooms, room)
+	}
+
+	return rooms, rows.Err()
+}
+
+func (s *PostgresStore) roomMembers(roomID int) ([]int, error) {
+	var members []int
+
+	rows, err := s.db.Query("SELECT user_id FROM room_has_users WHERE room_id = $1;", roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+
+		members = append(members, userID)
+	}
+
+	return members, rows.Err()
+}
+
+func (s *PostgresStore) isRoomAdmin(roomID int, userID int) (bool, error) {
+	var isAdmin bool
+
+	err := s.db.QueryRow("SELECT is_admin FROM room_has_users WHERE room_id = $1 AND user_id = $2;", roomID, userID).Scan(&isAdmin)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return isAdmin, err
+}
+
+func (s *PostgresStore) addRoomMember(roomID int, userID int, isAdmin bool) error {
+	member, err := isRoomMember(s, roomID, userID)
+	if err != nil {
+		return err
+	}
+
+	if member {
+		return errAlreadyMember
+	}
+
+	_, err = s.db.Exec("INSERT INTO room_has_users (room_id, user_id, is_admin) VALUES ($1, $2, $3);", roomID, userID, isAdmin)
+
+	return err
+}
+
+func (s *PostgresStore) removeRoomMember(roomID int, userID int) error {
+	_, err := s.db.Exec("DELETE FROM room_has_users WHERE room_id = $1 AND user_id = $2;", roomID, userID)
+
+	return err
+}
+
+// conversations returns the users the given user has a conversation with,
+// whichever of them started it.
+func (s *PostgresStore) conversations(userID int) ([]User, error) {
+	var conversations []User
+
+	rows, err := s.db.Query("SELECT id, name, email, last_seen, profile_picture FROM chat_users c WHERE c.id IN (SELECT receiver_user_id FROM user_conversations WHERE user_id = $1) OR c.id IN (SELECT user_id FROM user_conversations WHERE receiver_user_id = $1) ORDER BY id;", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var conversation User
+		if err := rows.Scan(&conversation.ID, &conversation.Name, &conversation.Email, &conversation.LastSeen, &conversation.ProfilePicture); err != nil {
+			return nil, err
+		}
+
+		conversations = append(conversations, conversation)
+	}
+
+	return conversations, rows.Err()
+}
+
+// hasConversation reports whether two users have a conversation, whichever
+// of them started it.
+func (s *PostgresStore) hasConversation(userID int, peerID int) (bool, error) {
+	var exists bool
+
+	err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM user_conversations WHERE (user_id = $1 AND receiver_user_id = $2) OR (user_id = $2 AND receiver_user_id = $1));", userID, peerID).Scan(&exists)
+
+	return exists, err
+}
+
+// insertMessages writes a batch of messages in a single transaction and
+// returns their chatlog IDs in the same order.
+func (s *PostgresStore) insertMessages(messages []Message) ([]int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, len(messages))
+	for i, message := range messages {
+		if ids[i], err = insertMessage(tx, message); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	return ids, tx.Commit()
+}
+
+// insertMessage writes one chat message to the chatlog and returns its ID.
+func insertMessage(tx *sql.Tx, message Message) (int64, error) {
+	var id int64
+
+	senderID, err := strconv.Atoi(message.Sender)
+	if err != nil {
+		return 0, err
+	}
+
+	// Room messages have no receiver and messages outside threads no
+	// thread.
+	var receiverID, roomID, replyTo, threadRoot sql.NullInt64
+
+	if message.Receiver != "" {
+		id, err := strconv.Atoi(message.Receiver)
+		if err != nil {
+			return 0, err
+		}
+		receiverID = sql.NullInt64{Int64: int64(id), Valid: true}
+	}
+
+	if message.RoomID != "" {
+		id, err := strconv.Atoi(message.RoomID)
+		if err != nil {
+			return 0, err
+		}
+		roomID = sql.NullInt64{Int64: int64(id), Valid: true}
+	}
+
+	if message.ReplyTo != 0 {
+		replyTo = sql.NullInt64{Int64: message.ReplyTo, Valid: true}
+		threadRoot = sql.NullInt64{Int64: message.ThreadRoot, Valid: true}
+	}
+
+	err = tx.QueryRow("INSERT INTO chatlog (sender, receiver, message, room_id, timestamp, created_at, reply_to, thread_root) VALUES ($1, $2, $3, $4, $5, to_timestamp($5::FLOAT8 / 1000), $6, $7) RETURNING id",
+		senderID, receiverID, message.Message, roomID, message.Timestamp, replyTo, threadRoot).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	// A direct message starts a conversation between the two users unless
+	// they already have one.
+	if !roomID.Valid {
+		if _, err := tx.Exec("INSERT INTO user_conversations (user_id, receiver_user_id) SELECT $1::INT8, $2::INT8 WHERE NOT EXISTS (SELECT 1 FROM user_conversations WHERE (user_id = $1 AND receiver_user_id = $2) OR (user_id = $2 AND receiver_user_id = $1));", senderID, receiverID); err != nil {
+			return 0, err
+		}
+	}
+
+	// The hub has checked that the attachments are free, but another
+	// message may have taken one in the meantime.
+	for _, attachment := range message.Attachments {
+		result, err := tx.Exec("UPDATE attachments SET message_id = $1 WHERE id = $2 AND message_id IS NULL;", id, attachment.ID)
+		if err != nil {
+			return 0, err
+		}
+
+		linked, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+
+		if linked == 0 {
+			return 0, errAttachmentTaken
+		}
+	}
+
+	return id, nil
+}
+
+func (s *PostgresStore) getMessage(id int64) (Message, error) {
+	messages, err := s.queryMessages("SELECT "+messageColumns+" FROM chatlog WHERE id = $1;", id)
+	if err != nil {
+		return Message{}, err
+	}
+
+	if len(messages) == 0 {
+		return Message{}, errNotFound
+	}
+
+	return messages[0], nil
+}
+
+// editMessage replaces the text of a message, keeping the earlier text in
+// message_edits.
+func (s *PostgresStore) editMessage(id int64, text string, editorID int, editedAt int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("INSERT INTO message_edits (message_id, message, edited_by, edited_at) SELECT id, message, $2, $3 FROM chatlog WHERE id = $1 AND deleted_at IS NULL;", id, editorID, editedAt); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	result, err := tx.Exec("UPDATE chatlog SET message = $1, edited_at = $2 WHERE id = $3 AND deleted_at IS NULL;", text, editedAt, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		if err != nil {
+			return err
+		}
+		return errNotFound
+	}
+
+	return tx.Commit()
+}
+
+// deleteMessage turns a message into a tombstone and drops its edit
+// history and reactions.
+func (s *PostgresStore) deleteMessage(id int64, deletedAt int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		"DELETE FROM message_edits WHERE message_id = $1;",
+		"DELETE FROM message_reactions WHERE message_id = $1;",
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	result, err := tx.Exec("UPDATE chatlog SET message = '', deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL;", deletedAt, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		if err != nil {
+			return err
+		}
+		return errNotFound
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) messageEdits(id int64) ([]MessageEdit, error) {
+	var edits []MessageEdit
+
+	rows, err := s.db.Query("SELECT message, edited_by, edited_at FROM message_edits WHERE message_id = $1 ORDER BY edited_at, id;", id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var edit MessageEdit
+		var editorID sql.NullInt64
+		if err := rows.Scan(&edit.Message, &editorID, &edit.EditedAt); err != nil {
+			return nil, err
+		}
+
+		if editorID.Valid {
+			edit.EditedBy = strconv.FormatInt(editorID.Int64, 10)
+		}
+		edits = append(edits, edit)
+	}
+
+	return edits, rows.Err()
+}
+
+// addReaction adds a reaction and reports whether it was new.
+func (s *PostgresStore) addReaction(messageID int64, userID int, emoji string) (bool, error) {
+	result, err := s.db.Exec("INSERT INTO message_reactions (message_id, user_id, emoji) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING;", messageID, userID, emoji)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+
+	return n > 0, err
+}
+
+// removeReaction removes a reaction and reports whether there was one.
+func (s *PostgresStore) removeReaction(messageID int64, userID int, emoji string) (bool, error) {
+	result, err := s.db.Exec("DELETE FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3;", messageID, userID, emoji)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+
+	return n > 0, err
+}
+
+func (s *PostgresStore) messageReactions(messageIDs []int64) ([]Reaction, error) {
+	var reactions []Reaction
+
+	rows, err := s.db.Query("SELECT message_id, user_id, emoji FROM message_reactions WHERE message_id = ANY($1) ORDER BY created_at, user_id;", pq.Array(messageIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var reaction Reaction
+		var userID int64
+		if err := rows.Scan(&reaction.MessageID, &userID, &reaction.Emoji); err != nil {
+			return nil, err
+		}
+
+		reaction.UserID = strconv.FormatInt(userID, 10)
+		reactions = append(reactions, reaction)
+	}
+
+	return reactions, rows.Err()
+}
+
+func (s *PostgresStore) createAttachment(attachment *Attachment) error {
+	return s.db.QueryRow("INSERT INTO attachments (uploader_id, name, content_type, size, width, height, blob_key, thumbnail_key, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id;",
+		attachment.uploaderID, attachment.Name, attachment.ContentType, attachment.Size, attachment.Width, attachment.Height, attachment.blobKey, attachment.thumbnailKey, attachment.CreatedAt).Scan(&attachment.ID)
+}
+
+func (s *PostgresStore) getAttachment(id int64) (Attachment, error) {
+	attachment, err := scanAttachment(s.db.QueryRow("SELECT "+attachmentColumns+" FROM attachments WHERE id = $1;", id))
+
+	return attachment, notFound(err)
+}
+
+func (s *PostgresStore) messageAttachments(messageIDs []int64) ([]Attachment, error) {
+	var attachments []Attachment
+
+	rows, err := s.db.Query("SELECT "+attachmentColumns+" FROM attachments WHERE message_id = ANY($1) ORDER BY id;", pq.Array(messageIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, rows.Err()
+}
+
+// deleteStaleAttachments deletes the attachments uploaded before the given
+// time and never sent, and the attachments of deleted messages. The deleted
+// attachments are returned for removing their blobs.
+func (s *PostgresStore) deleteStaleAttachments(uploadedBefore int64) ([]Attachment, error) {
+	return deleteAttachments(s.db, "(message_id IS NULL AND created_at < $1) OR message_id IN (SELECT id FROM chatlog WHERE deleted_at IS NOT NULL)", uploadedBefore)
+}
+
+// scanAttachment reads a row of attachmentColumns.
+func scanAttachment(row interface{ Scan(...interface{}) error }) (Attachment, error) {
+	var attachment Attachment
+	var messageID sql.NullInt64
+
+	err := row.Scan(&attachment.ID, &attachment.uploaderID, &messageID, &attachment.Name, &attachment.ContentType, &attachment.Size,
+		&attachment.Width, &attachment.Height, &attachment.blobKey, &attachment.thumbnailKey, &attachment.CreatedAt)
+	attachment.MessageID = messageID.Int64
+
+	return attachment, err
+}
+
+func (s *PostgresStore) roomMessages(roomID int) ([]Message, error) {
+	return s.queryMessages("SELECT "+messageColumns+" FROM chatlog WHERE room_id = $1 ORDER BY timestamp, id;", roomID)
+}
+
+func (s *PostgresStore) directMessages(userID int, peerID int) ([]Message, error) {
+	return s.queryMessages("SELECT "+messageColumns+" FROM chatlog WHERE ((sender = $1 AND receiver = $2) OR (sender = $2 AND receiver = $1)) AND room_id IS NULL ORDER BY timestamp, id;", userID, peerID)
+}
+
+func (s *PostgresStore) roomHistory(roomID int, page historyPage) ([]Message, error) {
+	return s.queryHistory("room_id = $1", page, roomID)
+}
+
+func (s *PostgresStore) directHistory(userID int, peerID int, page historyPage) ([]Message, error) {
+	return s.queryHistory("((sender = $1 AND receiver = $2) OR (sender = $2 AND receiver = $1)) AND room_id IS NULL", page, userID, peerID)
+}
+
+// markRead moves the read marker of a conversation forward to messageID and
+// returns the marker. It fails with errNotFound if the message is not in the
+// conversation.
+func (s *PostgresStore) markRead(userID int, roomID int, peerID int, messageID int64) (int64, error) {
+	conversation := "room_id = $2"
+	if roomID == 0 {
+		conversation = "room_id IS NULL AND ((sender = $1 AND receiver = $3) OR (sender = $3 AND receiver = $1))"
+	}
+
+	var lastReadID int64
+	err := s.db.QueryRow("INSERT INTO read_markers (user_id, room_id, peer_id, last_read_id, updated_at) SELECT $1::INT8, $2::INT8, $3::INT8, id, now() FROM chatlog WHERE id = $4 AND "+conversation+
+		" ON CONFLICT (user_id, room_id, peer_id) DO UPDATE SET last_read_id = GREATEST(read_markers.last_read_id, excluded.last_read_id), updated_at = excluded.updated_at RETURNING last_read_id;",
+		userID, roomID, peerID, messageID).Scan(&lastReadID)
+
+	return lastReadID, notFound(err)
+}
+
+// conversationStates counts the unread messages and finds the latest
+// message of the rooms of userID and of its direct conversations with
+// messages, in a single pass over the chatlog.
+func (s *PostgresStore) conversationStates(userID int) (map[conversation]conversationState, error) {
+	states := make(map[conversation]conversationState)
+
+	rows, err := s.db.Query("SELECT DISTINCT ON (conversation_room, conversation_peer) conversation_room, conversation_peer, count(unread) OVER (PARTITION BY conversation_room, conversation_peer), "+messageColumns+
+		" FROM (SELECT v.*, CASE WHEN v.sender IS DISTINCT FROM $1 AND v.deleted_at IS NULL AND v.id > COALESCE(m.last_read_id, 0) THEN 1 END AS unread"+
+		" FROM (SELECT "+messageColumns+", COALESCE(room_id, 0) AS conversation_room, CASE WHEN room_id IS NOT NULL THEN 0 WHEN sender = $1 THEN receiver ELSE sender END AS conversation_peer"+
+		" FROM chatlog WHERE room_id IN (SELECT room_id FROM room_has_users WHERE user_id = $1) OR (room_id IS NULL AND (sender = $1 OR receiver = $1))) v"+
+		" LEFT JOIN read_markers m ON m.user_id = $1 AND m.room_id = v.conversation_room AND m.peer_id = v.conversation_peer) c"+
+		" ORDER BY conversation_room, conversation_peer, timestamp DESC, id DESC;", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var c conversation
+		var state conversationState
+		message, err := scanMessage(rows, &c.roomID, &c.peerID, &state.unread)
+		if err != nil {
+			return nil, err
+		}
+
+		state.latest = &message
+		states[c] = state
+	}
+
+	return states, rows.Err()
+}
+
+func (s *PostgresStore) threadHistory(rootID int64, page historyPage) ([]Message, error) {
+	return s.queryHistory("thread_root = $1", page, rootID)
+}
+
+// searchMessages finds the messages matching a query with the inverted
+// index on message_tsv, in the rooms and direct conversations of userID.
+func (s *PostgresStore) searchMessages(userID int, query searchQuery, page historyPage) ([]Message, error) {
+	where := "deleted_at IS NULL AND (room_id IN (SELECT room_id FROM room_has_users WHERE user_id = $1) OR (room_id IS NULL AND (sender = $1 OR receiver = $1)))"
+	args := []interface{}{userID}
+
+	// The words are split by the same parser the index was built with.
+	if query.text != "" {
+		args = append(args, query.text)
+		where += fmt.Sprintf(" AND message_tsv @@ plainto_tsquery('simple', $%d)", len(args))
+	}
+
+	for _, phrase := range query.phraseTexts {
+		args = append(args, phrase)
+		where += fmt.Sprintf(" AND message_tsv @@ phraseto_tsquery('simple', $%d)", len(args))
+	}
+
+	if query.senderID != 0 {
+		args = append(args, query.senderID)
+		where += fmt.Sprintf(" AND sender = $%d", len(args))
+	}
+
+	if query.since != 0 {
+		args = append(args, query.since)
+		where += fmt.Sprintf(" AND timestamp >= $%d", len(args))
+	}
+
+	if query.until != 0 {
+		args = append(args, query.until)
+		where += fmt.Sprintf(" AND timestamp < $%d", len(args))
+	}
+
+	return s.queryHistory(where, page, args...)
+}
+
+// threadSummaries counts the replies of thread roots and finds their latest
+// reply. Roots without replies are left out.
+func (s *PostgresStore) threadSummaries(rootIDs []int64) (map[int64]ThreadSummary, error) {
+	summaries := make(map[int64]ThreadSummary)
+
+	rows, err := s.db.Query("SELECT DISTINCT ON (thread_root) thread_root, count(*) OVER (PARTITION BY thread_root), id, sender, timestamp FROM chatlog WHERE thread_root = ANY($1) AND deleted_at IS NULL ORDER BY thread_root, timestamp DESC, id DESC;", pq.Array(rootIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var rootID int64
+		var summary ThreadSummary
+		var senderID sql.NullInt64
+		if err := rows.Scan(&rootID, &summary.ReplyCount, &summary.LastReplyID, &senderID, &summary.LastReplyAt); err != nil {
+			return nil, err
+		}
+
+		if senderID.Valid {
+			summary.LastReplySender = strconv.FormatInt(senderID.Int64, 10)
+		}
+		summaries[rootID] = summary
+	}
+
+	return summaries, rows.Err()
+}
+
+// threadParticipants returns the sender of a thread root and everyone who
+// replied to it.
+func (s *PostgresStore) threadParticipants(rootID int64) ([]int, error) {
+	var participants []int
+
+	rows, err := s.db.Query("SELECT DISTINCT sender FROM chatlog WHERE (id = $1 OR thread_root = $1) AND sender IS NOT NULL;", rootID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+
+		participants = append(participants, userID)
+	}
+
+	return participants, rows.Err()
+}
+
+// queryHistory selects a page of the chatlog rows matching where. The rows
+// are read from the cursor outwards and returned oldest first.
+func (s *PostgresStore) queryHistory(where string, page historyPage, args ...interface{}) ([]Message, error) {
+	order := "DESC"
+
+	if page.before != nil {
+		args = append(args, page.before.timestamp, page.before.id)
+		where += fmt.Sprintf(" AND (timestamp, id) < ($%d, $%d)", len(args)-1, len(args))
+	}
+
+	if page.after != nil {
+		args = append(args, page.after.timestamp, page.after.id)
+		where += fmt.Sprintf(" AND (timestamp, id) > ($%d, $%d)", len(args)-1, len(args))
+		order = "ASC"
+	}
+
+	args = append(args, page.limit)
+	query := fmt.Sprintf("SELECT %s FROM chatlog WHERE %s ORDER BY timestamp %s, id %s LIMIT $%d;", messageColumns, where, order, order, len(args))
+
+	messages, err := s.queryMessages(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if order == "DESC" {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+
+	return messages, nil
+}
+
+func (s *PostgresStore) queryMessages(query string, args ...interface{}) ([]Message, error) {
+	var messages []Message
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, message)
+	}
+
+	return messages, rows.Err()
+}
+
+// scanMessage reads a chatlog row selected as messageColumns, after the
+// columns read into extra.
+func scanMessage(rows *sql.Rows, extra ...interface{}) (Message, error) {
+	var message Message
+	var senderID, receiverID, roomID, editedAt, deletedAt, replyTo, threadRoot sql.NullInt64
+
+	if err := rows.Scan(append(extra, &message.ID, &senderID, &receiverID, &message.Message, &roomID, &message.Timestamp, &editedAt, &deletedAt, &replyTo, &threadRoot)...); err != nil {
+		return message, err
+	}
+
+	message.EditedAt = editedAt.Int64
+	message.DeletedAt = deletedAt.Int64
+	message.ReplyTo = replyTo.Int64
+	message.ThreadRoot = threadRoot.Int64
+
+	if senderID.Valid {
+		message.Sender = strconv.FormatInt(senderID.Int64, 10)
+	}
+	if receiverID.Valid {
+		message.Receiver = strconv.FormatInt(receiverID.Int64, 10)
+	}
+	if roomID.Valid {
+		message.RoomID = strconv.FormatInt(roomID.Int64, 10)
+	}
+
+	return message, nil
+}
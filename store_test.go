@@ -0,0 +1,709 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// storeImplementations are the stores the contract tests run against.
+var storeImplementations = []struct {
+	name     string
+	newStore func(t *testing.T) Store
+}{
+	{"memory", func(t *testing.T) Store { return newMemoryStore() }},
+	{"postgres", newTestPostgresStore},
+}
+
+// openTestDB connects to the database of HALOO_TEST_DSN. The test is skipped
+// when it is not set. Tests empty and migrate the database as they please,
+// so it must not hold anything worth keeping.
+func openTestDB(t *testing.T) *sql.DB {
+	dsn := os.Getenv("HALOO_TEST_DSN")
+	if dsn == "" {
+		t.Skip("HALOO_TEST_DSN is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// newTestPostgresStore returns a store on the test database with every
+// migration applied and every table empty.
+func newTestPostgresStore(t *testing.T) Store {
+	db := openTestDB(t)
+
+	migrator, err := newMigrator(db, "database/migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.up(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []string{"attachments", "message_reactions", "message_edits", "read_markers", "chatlog", "user_conversations", "room_has_users", "rooms", "chat_users"} {
+		if _, err := db.Exec("DELETE FROM " + table + ";"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return newPostgresStore(db)
+}
+
+// storeFixture has three users: alice is the admin of room, bob a member and
+// carol is not in it.
+type storeFixture struct {
+	alice, bob, carol User
+	room              Room
+}
+
+// forEachStore runs a test against every Store implementation, each with a
+// fresh store holding a storeFixture.
+func forEachStore(t *testing.T, test func(t *testing.T, store Store, f storeFixture)) {
+	for _, implementation := range storeImplementations {
+		t.Run(implementation.name, func(t *testing.T) {
+			store := implementation.newStore(t)
+			test(t, store, newStoreFixture(t, store))
+		})
+	}
+}
+
+func newStoreFixture(t *testing.T, store Store) storeFixture {
+	t.Helper()
+
+	var f storeFixture
+	users := []*User{&f.alice, &f.bob, &f.carol}
+	for i, name := range []string{"alice", "bob", "carol"} {
+		*users[i] = User{Name: name, Email: name + "@example.com"}
+		if err := store.createUser(users[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.room = Room{Name: "room"}
+	if err := store.createRoom(&f.room, f.alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.addRoomMember(f.room.ID, f.bob.ID, false); err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+// insert stores messages and returns them with their IDs.
+func insert(t *testing.T, store Store, messages ...Message) []Message {
+	t.Helper()
+
+	ids, err := store.insertMessages(messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range messages {
+		messages[i].ID = ids[i]
+	}
+
+	return messages
+}
+
+func roomMessage(sender User, room Room, text string, timestamp int64) Message {
+	return Message{Sender: strconv.Itoa(sender.ID), RoomID: strconv.Itoa(room.ID), Message: text, Timestamp: timestamp}
+}
+
+func directMessage(sender User, receiver User, text string, timestamp int64) Message {
+	return Message{Sender: strconv.Itoa(sender.ID), Receiver: strconv.Itoa(receiver.ID), Message: text, Timestamp: timestamp}
+}
+
+func messageIDs(messages []Message) []int64 {
+	ids := []int64{}
+	for _, message := range messages {
+		ids = append(ids, message.ID)
+	}
+
+	return ids
+}
+
+func TestStoreErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(store Store, f storeFixture) error
+		want error
+	}{
+		{"missing user", func(store Store, f storeFixture) error {
+			_, err := store.getUser(9999)
+			return err
+		}, errNotFound},
+		{"missing email", func(store Store, f storeFixture) error {
+			_, err := store.getUserByEmail("nobody@example.com")
+			return err
+		}, errNotFound},
+		{"email taken on create", func(store Store, f storeFixture) error {
+			return store.createUser(&User{Name: "other", Email: f.alice.Email})
+		}, errEmailTaken},
+		{"email taken on update", func(store Store, f storeFixture) error {
+			f.bob.Email = f.alice.Email
+			return store.updateUser(f.bob)
+		}, errEmailTaken},
+		{"missing room", func(store Store, f storeFixture) error {
+			_, err := store.getRoom(9999)
+			return err
+		}, errNotFound},
+		{"member added twice", func(store Store, f storeFixture) error {
+			return store.addRoomMember(f.room.ID, f.bob.ID, false)
+		}, errAlreadyMember},
+		{"missing message", func(store Store, f storeFixture) error {
+			_, err := store.getMessage(9999)
+			return err
+		}, errNotFound},
+		{"message deleted twice", func(store Store, f storeFixture) error {
+			ids, err := store.insertMessages([]Message{roomMessage(f.alice, f.room, "hi", 1)})
+			if err != nil {
+				return err
+			}
+			if err := store.deleteMessage(ids[0], 2); err != nil {
+				return err
+			}
+			return store.deleteMessage(ids[0], 3)
+		}, errNotFound},
+		{"attachment sent twice", func(store Store, f storeFixture) error {
+			attachment := Attachment{uploaderID: f.alice.ID, Name: "a.txt", ContentType: "text/plain", blobKey: "a", CreatedAt: 1}
+			if err := store.createAttachment(&attachment); err != nil {
+				return err
+			}
+			message := roomMessage(f.alice, f.room, "file", 1)
+			message.Attachments = []Attachment{{ID: attachment.ID}}
+			if _, err := store.insertMessages([]Message{message}); err != nil {
+				return err
+			}
+			_, err := store.insertMessages([]Message{message})
+			return err
+		}, errAttachmentTaken},
+		{"attachment twice in a batch", func(store Store, f storeFixture) error {
+			attachment := Attachment{uploaderID: f.alice.ID, Name: "a.txt", ContentType: "text/plain", blobKey: "a", CreatedAt: 1}
+			if err := store.createAttachment(&attachment); err != nil {
+				return err
+			}
+			message := roomMessage(f.alice, f.room, "file", 1)
+			message.Attachments = []Attachment{{ID: attachment.ID}}
+			_, err := store.insertMessages([]Message{message, message})
+			return err
+		}, errAttachmentTaken},
+		{"read marker of a missing message", func(store Store, f storeFixture) error {
+			_, err := store.markRead(f.alice.ID, f.room.ID, 0, 9999)
+			return err
+		}, errNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, store Store, f storeFixture) {
+				if err := test.call(store, f); err != test.want {
+					t.Errorf("err = %v, want %v", err, test.want)
+				}
+			})
+		})
+	}
+}
+
+func TestStoreRoomHistory(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store, f storeFixture) {
+		var messages []Message
+		for i := int64(1); i <= 5; i++ {
+			messages = append(messages, roomMessage(f.alice, f.room, "message", i*1000))
+		}
+		messages = insert(t, store, messages...)
+
+		at := func(i int) *messageCursor {
+			cursor := cursorOf(messages[i])
+			return &cursor
+		}
+
+		tests := []struct {
+			name string
+			page historyPage
+			want []int64
+		}{
+			{"newest page", historyPage{limit: 2}, messageIDs(messages[3:])},
+			{"everything", historyPage{limit: 10}, messageIDs(messages)},
+			{"before", historyPage{before: at(2), limit: 10}, messageIDs(messages[:2])},
+			{"before with limit", historyPage{before: at(4), limit: 2}, messageIDs(messages[2:4])},
+			{"after with limit", historyPage{after: at(1), limit: 2}, messageIDs(messages[2:4])},
+			{"between", historyPage{after: at(0), before: at(4), limit: 10}, messageIDs(messages[1:4])},
+			{"after the newest", historyPage{after: at(4), limit: 10}, []int64{}},
+		}
+
+		for _, test := range tests {
+			got, err := store.roomHistory(f.room.ID, test.page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := messageIDs(got); !reflect.DeepEqual(ids, test.want) {
+				t.Errorf("%s: got %v, want %v", test.name, ids, test.want)
+			}
+		}
+	})
+}
+
+func TestStoreDirectHistory(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store, f storeFixture) {
+		messages := insert(t, store,
+			directMessage(f.alice, f.bob, "one", 1000),
+			directMessage(f.bob, f.alice, "two", 2000),
+			directMessage(f.alice, f.carol, "other", 3000),
+			roomMessage(f.alice, f.room, "room", 4000),
+		)
+
+		for _, userID := range []int{f.alice.ID, f.bob.ID} {
+			peerID := f.alice.ID + f.bob.ID - userID
+
+			got, err := store.directHistory(userID, peerID, historyPage{limit: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids, want := messageIDs(got), messageIDs(messages[:2]); !reflect.DeepEqual(ids, want) {
+				t.Errorf("history of %d with %d: got %v, want %v", userID, peerID, ids, want)
+			}
+		}
+	})
+}
+
+func TestStoreEditAndDelete(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store, f storeFixture) {
+		message := insert(t, store, roomMessage(f.bob, f.room, "first", 1000))[0]
+
+		if err := store.editMessage(message.ID, "second", f.alice.ID, 2000); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := store.getMessage(message.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Message != "second" || got.EditedAt != 2000 {
+			t.Errorf("edited message = %q at %d, want second at 2000", got.Message, got.EditedAt)
+		}
+
+		edits, err := store.messageEdits(message.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []MessageEdit{{Message: "first", EditedBy: strconv.Itoa(f.alice.ID), EditedAt: 2000}}
+		if !reflect.DeepEqual(edits, want) {
+			t.Errorf("edits = %v, want %v", edits, want)
+		}
+
+		if _, err := store.addReaction(message.ID, f.alice.ID, "👍"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.deleteMessage(message.ID, 3000); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err = store.getMessage(message.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Message != "" || got.DeletedAt != 3000 {
+			t.Errorf("deleted message = %q at %d, want no text at 3000", got.Message, got.DeletedAt)
+		}
+
+		if edits, _ := store.messageEdits(message.ID); len(edits) != 0 {
+			t.Errorf("edits of a deleted message = %v", edits)
+		}
+		if reactions, _ := store.messageReactions([]int64{message.ID}); len(reactions) != 0 {
+			t.Errorf("reactions of a deleted message = %v", reactions)
+		}
+	})
+}
+
+func TestStoreReactions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store, f storeFixture) {
+		message := insert(t, store, roomMessage(f.bob, f.room, "hello", 1000))[0]
+
+		steps := []struct {
+			name    string
+			add     bool
+			userID  int
+			emoji   string
+			changed bool
+		}{
+			{"add", true, f.alice.ID, "👍", true},
+			{"add again", true, f.alice.ID, "👍", false},
+			{"add another emoji", true, f.alice.ID, "🎉", true},
+			{"add by another user", true, f.bob.ID, "👍", true},
+			{"remove", false, f.alice.ID, "👍", true},
+			{"remove again", false, f.alice.ID, "👍", false},
+		}
+
+		for _, step := range steps {
+			var changed bool
+			var err error
+			if step.add {
+				changed, err = store.addReaction(message.ID, step.userID, step.emoji)
+			} else {
+				changed, err = store.removeReaction(message.ID, step.userID, step.emoji)
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+			if changed != step.changed {
+				t.Errorf("%s: changed = %v, want %v", step.name, changed, step.changed)
+			}
+		}
+
+		reactions, err := store.messageReactions([]int64{message.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, reaction := range reactions {
+			got = append(got, reaction.UserID+" "+reaction.Emoji)
+		}
+		sort.Strings(got)
+
+		want := []string{strconv.Itoa(f.alice.ID) + " 🎉", strconv.Itoa(f.bob.ID) + " 👍"}
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("reactions = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestStoreMemberships(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store, f storeFixture) {
+		tests := []struct {
+			userID        int
+			member, admin bool
+		}{
+			{f.alice.ID, true, true},
+			{f.bob.ID, true, false},
+			{f.carol.ID, false, false},
+		}
+
+		for _, test := range tests {
+			member, err := isRoomMember(store, f.room.ID, test.userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			admin, err := store.isRoomAdmin(f.room.ID, test.userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if member != test.member || admin != test.admin {
+				t.Errorf("user %d: member %v admin %v, want %v %v", test.userID, member, admin, test.member, test.admin)
+			}
+		}
+
+		if err := store.removeRoomMember(f.room.ID, f.bob.ID); err != nil {
+			t.Fatal(err)
+		}
+		if member, _ := isRoomMember(store, f.room.ID, f.bob.ID); member {
+			t.Error("bob is still a member after being removed")
+		}
+
+		rooms, err := store.userRooms(f.alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rooms) != 1 || rooms[0].ID != f.room.ID {
+			t.Errorf("rooms of alice = %v", rooms)
+		}
+	})
+}
+
+func TestStoreReadMarkers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store, f storeFixture) {
+		messages := insert(t, store,
+			directMessage(f.bob, f.alice, "one", 1000),
+			directMessage(f.bob, f.alice, "two", 2000),
+			directMessage(f.bob, f.alice, "three", 3000),
+		)
+
+		steps := []struct {
+			name       string
+			read       int64
+			wantMarker int64
+			wantUnread int
+		}{
+			{"second", messages[1].ID, messages[1].ID, 1},
+			{"first does not move back", messages[0].ID, messages[1].ID, 1},
+			{"last", messages[2].ID, messages[2].ID, 0},
+		}
+
+		unread := func() int {
+			t.Helper()
+
+			states, err := store.conversationStates(f.alice.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return states[conversation{peerID: f.bob.ID}].unread
+		}
+
+		if n := unread(); n != 3 {
+			t.Fatalf("unread before reading = %d", n)
+		}
+
+		if _, err := store.markRead(f.alice.ID, f.room.ID, 0, messages[0].ID); err != errNotFound {
+			t.Errorf("marking a message of another conversation: err = %v, want errNotFound", err)
+		}
+
+		for _, step := range steps {
+			marker, err := store.markRead(f.alice.ID, 0, f.bob.ID, step.read)
+			if err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+			if n := unread(); marker != step.wantMarker || n != step.wantUnread {
+				t.Errorf("%s: marker %d unread %d, want %d %d", step.name, marker, n, step.wantMarker, step.wantUnread)
+			}
+		}
+	})
+}
+
+func TestStoreConversations(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store, f storeFixture) {
+		messages := insert(t, store,
+			roomMessage(f.bob, f.room, "room", 1000),
+			directMessage(f.carol, f.alice, "hi alice", 2000),
+			directMessage(f.alice, f.carol, "hi carol", 3000),
+		)
+
+		// The direct messages started a conversation for both users.
+		for _, pair := range [][2]User{{f.alice, f.carol}, {f.carol, f.alice}} {
+			peers, err := store.conversations(pair[0].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(peers) != 1 || peers[0].ID != pair[1].ID {
+				t.Errorf("conversations of %s = %v", pair[0].Name, peers)
+			}
+		}
+
+		states, err := store.conversationStates(f.alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[conversation]struct {
+			unread   int
+			latestID int64
+		}{
+			{roomID: f.room.ID}:  {1, messages[0].ID},
+			{peerID: f.carol.ID}: {1, messages[2].ID},
+		}
+		if len(states) != len(want) {
+			t.Errorf("states = %v", states)
+		}
+		for c, w := range want {
+			state := states[c]
+			if state.unread != w.unread || state.latest == nil || state.latest.ID != w.latestID {
+				t.Errorf("state of %+v = %+v, want %d unread and latest %d", c, state, w.unread, w.latestID)
+			}
+		}
+	})
+}
+
+func TestStoreSearch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store, f storeFixture) {
+		messages := insert(t, store,
+			roomMessage(f.alice, f.room, "green apple pie", 1000),
+			roomMessage(f.bob, f.room, "apple green tea", 2000),
+			directMessage(f.alice, f.bob, "an apple a day", 3000),
+			directMessage(f.carol, f.alice, "apple for carol", 4000),
+		)
+
+		tests := []struct {
+			query  string
+			userID int
+			want   []int64
+		}{
+			{"apple", f.bob.ID, messageIDs(messages[:3])},
+			{"apple green", f.bob.ID, messageIDs(messages[:2])},
+			{`"green apple"`, f.bob.ID, messageIDs(messages[:1])},
+			{"apple", f.carol.ID, messageIDs(messages[3:])},
+			{"banana", f.alice.ID, []int64{}},
+		}
+
+		for _, test := range tests {
+			query, problem := parseSearchQuery(test.query)
+			if problem != "" {
+				t.Fatal(problem)
+			}
+
+			got, err := store.searchMessages(test.userID, query, historyPage{limit: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := messageIDs(got); !reflect.DeepEqual(ids, test.want) {
+				t.Errorf("%s for %d: got %v, want %v", test.query, test.userID, ids, test.want)
+			}
+		}
+	})
+}
+
+func TestStoreSetLastSeen(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store, f storeFixture) {
+		later := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+		for _, lastSeen := range []time.Time{later, later.Add(-time.Hour)} {
+			if err := store.setLastSeen(f.alice.ID, lastSeen); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		user, err := store.getUser(f.alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := time.Parse(time.RFC3339Nano, user.LastSeen); err != nil || !got.Equal(later) {
+			t.Errorf("last_seen = %q, want %v", user.LastSeen, later)
+		}
+	})
+}
+
+func TestStoreDeleteUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store, f storeFixture) {
+		var unsent, sent Attachment
+		for _, attachment := range []*Attachment{&unsent, &sent} {
+			*attachment = Attachment{uploaderID: f.bob.ID, Name: "a.txt", ContentType: "text/plain", blobKey: "key", CreatedAt: 1}
+			if err := store.createAttachment(attachment); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		withFile := directMessage(f.bob, f.alice, "file", 1000)
+		withFile.Attachments = []Attachment{{ID: sent.ID}}
+
+		messages := insert(t, store,
+			withFile,
+			directMessage(f.alice, f.bob, "reply", 2000),
+			roomMessage(f.bob, f.room, "by bob", 3000),
+			roomMessage(f.alice, f.room, "by alice", 4000),
+			directMessage(f.alice, f.carol, "kept", 5000),
+		)
+
+		deleted, err := store.deleteUser(f.bob.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var deletedIDs []int64
+		for _, attachment := range deleted {
+			deletedIDs = append(deletedIDs, attachment.ID)
+		}
+		sort.Slice(deletedIDs, func(i, j int) bool { return deletedIDs[i] < deletedIDs[j] })
+		if want := []int64{unsent.ID, sent.ID}; !reflect.DeepEqual(deletedIDs, want) {
+			t.Errorf("deleted attachments = %v, want %v", deletedIDs, want)
+		}
+
+		if _, err := store.getUser(f.bob.ID); err != errNotFound {
+			t.Errorf("getUser after delete: err = %v, want errNotFound", err)
+		}
+
+		for i, wantErr := range []error{errNotFound, errNotFound, nil, nil, nil} {
+			if _, err := store.getMessage(messages[i].ID); err != wantErr {
+				t.Errorf("message %q: err = %v, want %v", messages[i].Message, err, wantErr)
+			}
+		}
+
+		// The room message is left as a tombstone for the replies to it.
+		if tombstone, err := store.getMessage(messages[2].ID); err == nil && (tombstone.Sender != "" || tombstone.Message != "" || tombstone.DeletedAt == 0) {
+			t.Errorf("room message of the deleted user = %+v", tombstone)
+		}
+
+		if member, _ := isRoomMember(store, f.room.ID, f.bob.ID); member {
+			t.Error("deleted user is still a room member")
+		}
+	})
+}
+
+func TestStoreDeleteLastAdmin(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store, f storeFixture) {
+		if err := store.addRoomMember(f.room.ID, f.carol.ID, false); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := store.deleteUser(f.alice.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		// bob has the lowest ID of the members left.
+		for _, user := range []User{f.bob, f.carol} {
+			isAdmin, err := store.isRoomAdmin(f.room.ID, user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isAdmin != (user.ID == f.bob.ID) {
+				t.Errorf("%s is admin: %v", user.Name, isAdmin)
+			}
+		}
+	})
+}
+
+func TestStoreDeleteStaleAttachments(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store, f storeFixture) {
+		tests := []struct {
+			name       string
+			createdAt  int64
+			sent       bool
+			deleteSent bool
+			stale      bool
+		}{
+			{"old unsent", 1000, false, false, true},
+			{"new unsent", 3000, false, false, false},
+			{"old sent", 1000, true, false, false},
+			{"sent in a deleted message", 3000, true, true, true},
+		}
+
+		stale := make(map[int64]bool)
+		for _, test := range tests {
+			attachment := Attachment{uploaderID: f.alice.ID, Name: test.name, ContentType: "text/plain", blobKey: test.name, CreatedAt: test.createdAt}
+			if err := store.createAttachment(&attachment); err != nil {
+				t.Fatal(err)
+			}
+			stale[attachment.ID] = test.stale
+
+			if test.sent {
+				message := roomMessage(f.alice, f.room, "", test.createdAt)
+				message.Attachments = []Attachment{{ID: attachment.ID}}
+				message = insert(t, store, message)[0]
+
+				if test.deleteSent {
+					if err := store.deleteMessage(message.ID, test.createdAt+1); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+		}
+
+		deleted, err := store.deleteStaleAttachments(2000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := make(map[int64]bool)
+		for _, attachment := range deleted {
+			got[attachment.ID] = true
+		}
+
+		for id, wantStale := range stale {
+			_, err := store.getAttachment(id)
+			if got[id] != wantStale || (err == errNotFound) != wantStale {
+				t.Errorf("attachment %d: deleted %v, lookup err %v, want stale %v", id, got[id], err, wantStale)
+			}
+		}
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// ThreadSummary describes the replies to a thread root.
+type ThreadSummary struct {
+	ReplyCount      int    `json:"reply_count"`
+	LastReplyID     int64  `json:"last_reply_id"`
+	LastReplySender string `json:"last_reply_sender"`
+	LastReplyAt     int64  `json:"last_reply_at"`
+}
+
+// resolveThread checks that the message a new message replies to exists and
+// is in the same conversation, and sets the thread root of the new message.
+// Runs in the readPump, see prepare.
+func (h *Hub) resolveThread(message *Message) *ProtocolError {
+	if message.ReplyTo == 0 {
+		return nil
+	}
+
+	parent, err := h.store.getMessage(message.ReplyTo)
+	if err == errNotFound {
+		return protocolError(errorInvalidMessage, "Message replied to not found")
+	}
+	if err != nil {
+		log.Printf("error getting message: %v", err)
+		return protocolError(errorInternal, "Message replied to could not be read")
+	}
+
+	if !sameConversation(parent, *message) {
+		return protocolError(errorInvalidMessage, "Reply must be in the conversation of the message replied to")
+	}
+
+	if parent.DeletedAt != 0 {
+		return protocolError(errorInvalidMessage, "Message replied to has been deleted")
+	}
+
+	message.ThreadRoot = parent.ThreadRoot
+	if message.ThreadRoot == 0 {
+		message.ThreadRoot = parent.ID
+	}
+
+	return nil
+}
+
+// sameConversation reports whether two messages are in the same room or
+// between the same two users.
+func sameConversation(a Message, b Message) bool {
+	if a.RoomID != "" || b.RoomID != "" {
+		return a.RoomID == b.RoomID
+	}
+
+	return (a.Sender == b.Sender && a.Receiver == b.Receiver) || (a.Sender == b.Receiver && a.Receiver == b.Sender)
+}
+
+// threadRecipients returns the other participants of the room thread a new
+// reply goes to who are still members of the room. Direct message threads
+// need no notification, both participants get every message anyway. Runs in
+// the readPump, see prepare.
+func (h *Hub) threadRecipients(reply Message) []int {
+	if reply.ThreadRoot == 0 || reply.RoomID == "" {
+		return nil
+	}
+
+	participants, err := h.store.threadParticipants(reply.ThreadRoot)
+	if err != nil {
+		log.Printf("error getting thread participants: %v", err)
+		return nil
+	}
+
+	roomID, _ := strconv.Atoi(reply.RoomID)
+	members, err := h.members.get(roomID)
+	if err != nil {
+		log.Printf("error getting room members: %v", err)
+		return nil
+	}
+
+	var recipients []int
+	for _, userID := range participants {
+		if members[userID] && strconv.Itoa(userID) != reply.Sender {
+			recipients = append(recipients, userID)
+		}
+	}
+
+	return recipients
+}
+
+// notifyThread sends a thread_reply frame with a new reply to the
+// recipients found by threadRecipients, on all of their devices.
+func (h *Hub) notifyThread(reply Message, recipients []int) {
+	if len(recipients) == 0 {
+		return
+	}
+
+	data := h.encode(Envelope{Type: typeThreadReply, Message: &reply})
+	if data == nil {
+		return
+	}
+
+	for _, userID := range recipients {
+		h.sendToUser(userID, data)
+	}
+}
+
+// attachThreads fills in the thread summaries of the thread roots among
+// messages.
+func attachThreads(store Store, messages []Message) error {
+	var rootIDs []int64
+	for _, message := range messages {
+		if message.ThreadRoot == 0 {
+			rootIDs = append(rootIDs, message.ID)
+		}
+	}
+
+	if len(rootIDs) == 0 {
+		return nil
+	}
+
+	summaries, err := store.threadSummaries(rootIDs)
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		if summary, ok := summaries[messages[i].ID]; ok {
+			messages[i].Thread = &summary
+		}
+	}
+
+	return nil
+}
+
+// serveThread returns the root of the thread of the message given in the
+// path together with a page of its replies. The page parameters work like
+// in the history endpoints.
+func serveThread(store Store, w http.ResponseWriter, r *http.Request, userID int) {
+	type ThreadResponse struct {
+		Root Message `json:"root"`
+		HistoryResponse
+	}
+
+	log.Println(r.URL)
+
+	id, ok := messageIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	root, err := store.getMessage(id)
+	if err == nil && root.ThreadRoot != 0 {
+		root, err = store.getMessage(root.ThreadRoot)
+	}
+	if err != nil {
+		if err != errNotFound {
+			log.Printf("error getting message: %v", err)
+			writeJSONError(w, 500, "Internal server error")
+			return
+		}
+
+		writeJSONError(w, 404, "Message not found")
+		return
+	}
+
+	visible, err := canReadMessage(store, userID, root)
+	if err != nil {
+		log.Printf("error checking room membership: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	if !visible {
+		writeJSONError(w, 403, "Not a participant of the conversation")
+		return
+	}
+
+	response, ok := loadHistory(w, r, func(page historyPage) ([]Message, error) {
+		return store.threadHistory(root.ID, page)
+	})
+	if !ok {
+		return
+	}
+
+	roots := []Message{root}
+	if err := attachThreads(store, roots); err != nil {
+		log.Printf("error reading thread summaries: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	for _, messages := range [][]Message{roots, response.Messages} {
+		if err := attachAttachments(store, messages); err != nil {
+			log.Printf("error reading attachments: %v", err)
+			writeJSONError(w, 500, "Internal server error")
+			return
+		}
+	}
+
+	writeJSON(w, 200, ThreadResponse{Root: roots[0], HistoryResponse: response})
+}
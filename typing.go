@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+// How often the hub looks for expired typing indicators.
+const typingCheckPeriod = time.Second
+
+// Length of the window typing frames are rate limited in.
+const typingRateWindow = time.Minute
+
+// Typing names the conversation a user is typing in, either a room or a DM
+// peer. The server adds the user when relaying it.
+type Typing struct {
+	UserID   string `json:"user_id,omitempty"`
+	RoomID   string `json:"room_id,omitempty"`
+	Receiver string `json:"receiver,omitempty"`
+}
+
+// typingKey identifies a user typing in one conversation. Exactly one of
+// roomID and receiverID is set.
+type typingKey struct {
+	userID     int
+	roomID     int
+	receiverID int
+}
+
+func typingKeyOf(message Message) typingKey {
+	key := typingKey{}
+	key.userID, _ = strconv.Atoi(message.Sender)
+	if message.RoomID != "" {
+		key.roomID, _ = strconv.Atoi(message.RoomID)
+	} else {
+		key.receiverID, _ = strconv.Atoi(message.Receiver)
+	}
+
+	return key
+}
+
+// requireConversation checks that a user has a conversation with the peer
+// of a DM typing frame, so that typing frames cannot be used to find out who
+// is online. Runs in the readPump, see prepare.
+func (h *Hub) requireConversation(userID int, peerID int) *ProtocolError {
+	exists, err := h.store.hasConversation(userID, peerID)
+	if err != nil {
+		log.Printf("error checking conversation: %v", err)
+		return protocolError(errorInternal, "Conversation could not be read")
+	}
+
+	if !exists {
+		return protocolError(errorForbidden, "No conversation with the user")
+	}
+
+	return nil
+}
+
+// handleTyping starts or stops a typing indicator. prepare has checked the
+// room membership or the DM conversation. Typing frames are not acked, only
+// rejected.
+func (h *Hub) handleTyping(client *Client, envelope Envelope) {
+	if !h.allowTyping(client) {
+		h.reject(client, envelope, protocolError(errorRateLimited, "Too many typing frames, slow down"))
+		return
+	}
+
+	key := typingKey{userID: client.userID}
+	if envelope.Typing.RoomID != "" {
+		key.roomID, _ = strconv.Atoi(envelope.Typing.RoomID)
+	} else {
+		key.receiverID, _ = strconv.Atoi(envelope.Typing.Receiver)
+	}
+
+	if envelope.Type == typeTypingStop {
+		h.stopTyping(key)
+		return
+	}
+
+	_, typing := h.typing[key]
+	h.typing[key] = time.Now().Add(time.Duration(config.Typing.TimeoutSeconds) * time.Second)
+	if !typing {
+		h.relayTyping(key, typeTypingStart)
+	}
+}
+
+// allowTyping counts a typing frame against the client's rate limit.
+func (h *Hub) allowTyping(client *Client) bool {
+	now := time.Now()
+	if now.Sub(client.typingWindow) >= typingRateWindow {
+		client.typingWindow = now
+		client.typingFrames = 0
+	}
+
+	client.typingFrames++
+
+	return client.typingFrames <= config.Typing.MaxPerMinute
+}
+
+// stopTyping ends a typing indicator if it is on.
+func (h *Hub) stopTyping(key typingKey) {
+	if _, ok := h.typing[key]; !ok {
+		return
+	}
+
+	delete(h.typing, key)
+	h.relayTyping(key, typeTypingStop)
+}
+
+// stopAllTyping ends every typing indicator of a user.
+func (h *Hub) stopAllTyping(userID int) {
+	for key := range h.typing {
+		if key.userID == userID {
+			h.stopTyping(key)
+		}
+	}
+}
+
+// expireTyping ends the typing indicators that have not been renewed in time.
+func (h *Hub) expireTyping() {
+	now := time.Now()
+	for key, expires := range h.typing {
+		if now.After(expires) {
+			h.stopTyping(key)
+		}
+	}
+}
+
+// relayTyping sends a typing frame to the other subscribers of the room or
+// to the devices of the DM peer.
+func (h *Hub) relayTyping(key typingKey, frameType string) {
+	typing := Typing{UserID: strconv.Itoa(key.userID)}
+	if key.roomID != 0 {
+		typing.RoomID = strconv.Itoa(key.roomID)
+	} else {
+		typing.Receiver = strconv.Itoa(key.receiverID)
+	}
+
+	data := h.encode(Envelope{Type: frameType, Typing: &typing})
+	if data == nil {
+		return
+	}
+
+	if key.roomID == 0 {
+		h.sendToUser(key.receiverID, data)
+		return
+	}
+
+	for client := range h.rooms[key.roomID] {
+		if client.userID != key.userID {
+			h.deliver(client, data)
+		}
+	}
+}
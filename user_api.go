@@ -0,0 +1,241 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Length limits for user fields. Names, emails and pictures are stored in
+// VARCHAR(255) columns and bcrypt only uses the first 72 bytes of a password.
+const (
+	maxNameLength     = 255
+	maxEmailLength    = 255
+	maxPictureLength  = 255
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+func validateName(name string) string {
+	if name == "" {
+		return "Name is required"
+	}
+
+	if utf8.RuneCountInString(name) > maxNameLength {
+		return "Name is too long"
+	}
+
+	return ""
+}
+
+func validateEmail(email string) string {
+	if len(email) > maxEmailLength {
+		return "Email is too long"
+	}
+
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return "Email is not valid"
+	}
+
+	return ""
+}
+
+func validatePassword(password string) string {
+	if len(password) < minPasswordLength {
+		return "Password is too short"
+	}
+
+	if len(password) > maxPasswordLength {
+		return "Password is too long"
+	}
+
+	return ""
+}
+
+func validatePicture(picture string) string {
+	if utf8.RuneCountInString(picture) > maxPictureLength {
+		return "Picture is too long"
+	}
+
+	return ""
+}
+
+// serveCreateUser registers a new user.
+func serveCreateUser(store Store, w http.ResponseWriter, r *http.Request) {
+	type CreateUserRequest struct {
+		Name           string `json:"name"`
+		Email          string `json:"email"`
+		Password       string `json:"password"`
+		ProfilePicture string `json:"profile_picture"`
+	}
+
+	log.Println(r.URL)
+
+	var request CreateUserRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+
+	for _, problem := range []string{
+		validateName(request.Name),
+		validateEmail(request.Email),
+		validatePassword(request.Password),
+		validatePicture(request.ProfilePicture),
+	} {
+		if problem != "" {
+			writeJSONError(w, 400, problem)
+			return
+		}
+	}
+
+	hash, err := hashPassword(request.Password)
+	if err != nil {
+		log.Printf("error hashing password: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	user := User{Name: request.Name, Email: request.Email, Password: hash, ProfilePicture: request.ProfilePicture}
+	if err := store.createUser(&user); err != nil {
+		if err == errEmailTaken {
+			writeJSONError(w, 409, "Email is already in use")
+			return
+		}
+
+		log.Printf("error creating user: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	writeJSON(w, 201, user)
+}
+
+// serveUpdateUser updates the name, email or profile picture of the
+// authenticated user.
+func serveUpdateUser(store Store, w http.ResponseWriter, r *http.Request, userID int) {
+	type UpdateUserRequest struct {
+		Name           *string `json:"name"`
+		Email          *string `json:"email"`
+		ProfilePicture *string `json:"profile_picture"`
+	}
+
+	log.Println(r.URL)
+
+	user, ok := userFromPath(store, w, r, userID)
+	if !ok {
+		return
+	}
+
+	var request UpdateUserRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+
+	if request.Name != nil {
+		if problem := validateName(*request.Name); problem != "" {
+			writeJSONError(w, 400, problem)
+			return
+		}
+		user.Name = *request.Name
+	}
+
+	if request.Email != nil && *request.Email != user.Email {
+		if problem := validateEmail(*request.Email); problem != "" {
+			writeJSONError(w, 400, problem)
+			return
+		}
+
+		user.Email = *request.Email
+	}
+
+	if request.ProfilePicture != nil {
+		if problem := validatePicture(*request.ProfilePicture); problem != "" {
+			writeJSONError(w, 400, problem)
+			return
+		}
+		user.ProfilePicture = *request.ProfilePicture
+	}
+
+	if err := store.updateUser(user); err != nil {
+		if err == errEmailTaken {
+			writeJSONError(w, 409, "Email is already in use")
+			return
+		}
+
+		log.Printf("error updating user: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	writeJSON(w, 200, user)
+}
+
+// serveDeleteUser deletes the authenticated user along with their messages,
+// room memberships, conversations and attachments, and disconnects them.
+func serveDeleteUser(hub *Hub, blobs BlobStore, w http.ResponseWriter, r *http.Request, userID int) {
+	log.Println(r.URL)
+
+	store := hub.store
+
+	user, ok := userFromPath(store, w, r, userID)
+	if !ok {
+		return
+	}
+
+	rooms, err := store.userRooms(user.ID)
+	if err != nil {
+		log.Printf("error getting user rooms: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	attachments, err := store.deleteUser(user.ID)
+	if err != nil {
+		log.Printf("error deleting user: %v", err)
+		writeJSONError(w, 500, "Internal server error")
+		return
+	}
+
+	for _, room := range rooms {
+		hub.invalidate <- room.ID
+	}
+	hub.deletedUsers <- user.ID
+
+	for _, attachment := range attachments {
+		removeBlobs(blobs, attachment.blobKey, attachment.thumbnailKey)
+	}
+
+	w.WriteHeader(204)
+}
+
+// userFromPath loads the user given in the {id} path parameter. Users may
+// only modify their own account.
+func userFromPath(store Store, w http.ResponseWriter, r *http.Request, userID int) (User, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, 400, "Invalid user id")
+		return User{}, false
+	}
+
+	if id != userID {
+		writeJSONError(w, 403, "You can only modify your own account")
+		return User{}, false
+	}
+
+	user, err := store.getUser(id)
+	if err != nil {
+		if err != errNotFound {
+			log.Printf("error getting user: %v", err)
+			writeJSONError(w, 500, "Internal server error")
+			return User{}, false
+		}
+
+		writeJSONError(w, 404, "User not found")
+		return User{}, false
+	}
+
+	return user, true
+}